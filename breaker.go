@@ -0,0 +1,96 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const defaultBreakerReset = 30 * time.Second
+
+// breaker is the circuit breaker state of one address of a host.
+type breaker struct {
+	failures  int       // consecutive failed attempts
+	openUntil time.Time // when a trial attempt may go through again
+}
+
+func (d *Dialer) breakerReset() time.Duration {
+	if d.BreakerReset > 0 {
+		return d.BreakerReset
+	}
+	return defaultBreakerReset
+}
+
+// breakerAllows reports whether addr of e may be dialed. An open breaker
+// whose reset timeout elapsed lets this attempt through as its trial, and
+// keeps the others out until the next timeout.
+func (d *Dialer) breakerAllows(e *hostEntry, addr string, now time.Time) bool {
+	if d.BreakerThreshold <= 0 {
+		return true
+	}
+	e.breakerMx.Lock()
+	defer e.breakerMx.Unlock()
+
+	b := e.breakers[addr]
+	if b == nil || b.failures < d.BreakerThreshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(d.breakerReset())
+	return true
+}
+
+// usable reports whether e has an address whose breaker isn't open.
+func (d *Dialer) usable(e *hostEntry, now time.Time) bool {
+	if d.BreakerThreshold <= 0 || len(e.addrs) == 0 {
+		return len(e.addrs) > 0
+	}
+	e.breakerMx.Lock()
+	defer e.breakerMx.Unlock()
+
+	for _, addr := range e.addrs {
+		b := e.breakers[addr]
+		if b == nil || b.failures < d.BreakerThreshold || !now.Before(b.openUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// noteBreaker records an attempt to dial addr of e: a success closes its
+// breaker, and a failure counts towards opening it, or opens it again
+// after a trial. Canceled attempts, like Happy Eyeballs losers, don't
+// count.
+func (d *Dialer) noteBreaker(e *hostEntry, addr string, err error, now time.Time) {
+	if d.BreakerThreshold <= 0 || errors.Is(err, context.Canceled) {
+		return
+	}
+	e.breakerMx.Lock()
+	defer e.breakerMx.Unlock()
+
+	if err == nil {
+		delete(e.breakers, addr)
+		return
+	}
+	b := e.breakers[addr]
+	if b == nil {
+		if e.breakers == nil {
+			e.breakers = make(map[string]*breaker)
+		}
+		b = &breaker{}
+		e.breakers[addr] = b
+	}
+	b.failures++
+	if b.failures >= d.BreakerThreshold {
+		b.openUntil = now.Add(d.breakerReset())
+	}
+}
+
+// errBreakersOpen is returned when every address cached under key has its
+// breaker open.
+func errBreakersOpen(key string) error {
+	err := errors.New(`every address of host "` + key + `" has its breaker open`)
+	return &dialError{ErrAllAddrsUnreachable, err}
+}
@@ -0,0 +1,86 @@
+package cdialer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	var mx sync.Mutex
+	down := map[string]bool{"[10.0.0.1]:80": true}
+	dialed := map[string]int{}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			dialed[address]++
+			if down[address] {
+				return nil, errors.New("down")
+			}
+			return nil, nil
+		}},
+		TTL:              defaultTTL,
+		BreakerThreshold: 2,
+		BreakerReset:     50 * time.Millisecond,
+		// evicting would leave the breaker a single failure to count
+		ShouldEvict: func(err error) bool { return false },
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+	dial := func() map[string]int {
+		mx.Lock()
+		dialed = map[string]int{}
+		mx.Unlock()
+		for i := 0; i < 4; i++ {
+			_, err := d.Dial("tcp", "github.com:80")
+			assert.NoError(t, err)
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		return dialed
+	}
+
+	// the failing address is tried in turn until its breaker opens
+	assert.Equal(t, 2, dial()["[10.0.0.1]:80"])
+	assert.Equal(t, 0, dial()["[10.0.0.1]:80"])
+	assert.True(t, d.HostHealthy("github.com:80"))
+
+	// half-open, a single trial gets through and fails
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 1, dial()["[10.0.0.1]:80"])
+	assert.Equal(t, 0, dial()["[10.0.0.1]:80"])
+
+	// the trial connects, which closes the breaker
+	time.Sleep(60 * time.Millisecond)
+	mx.Lock()
+	delete(down, "[10.0.0.1]:80")
+	mx.Unlock()
+	assert.Equal(t, 2, dial()["[10.0.0.1]:80"])
+	assert.Empty(t, entry(d, "github.com:80").breakers)
+
+	// with every breaker open, dials fail without trying any address
+	mx.Lock()
+	down["[10.0.0.1]:80"], down["[10.0.0.2]:80"] = true, true
+	mx.Unlock()
+	for i := 0; i < 2; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Error(t, err)
+	}
+	assert.False(t, d.HostHealthy("github.com:80"))
+	assert.False(t, d.Healthy())
+	mx.Lock()
+	dialed = map[string]int{}
+	mx.Unlock()
+	for _, happyEyeballs := range []bool{false, true} {
+		d.HappyEyeballs = happyEyeballs
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	}
+	assert.Empty(t, dialed)
+}
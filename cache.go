@@ -0,0 +1,110 @@
+package cdialer
+
+import "sync"
+
+// cacheShards is how many independently locked buckets the host cache is
+// split into, so that dials of different hosts don't contend on one lock.
+const cacheShards = 64
+
+// hostCache maps cache keys to their entries. The zero value is ready to
+// use. Code that needs several shards locked at once locks them in order,
+// and d.mx is only ever taken after a shard's lock.
+type hostCache struct {
+	once   sync.Once
+	shards []cacheShard
+}
+
+type cacheShard struct {
+	mx    sync.RWMutex
+	addrs map[string]*hostEntry
+	_     [32]byte // keeps neighbouring locks off the same cache line
+}
+
+func (c *hostCache) init() {
+	c.once.Do(func() {
+		if c.shards == nil {
+			c.shards = make([]cacheShard, cacheShards)
+		}
+	})
+}
+
+// shard returns the shard key belongs to.
+func (c *hostCache) shard(key string) *cacheShard {
+	c.init()
+
+	// FNV-1a, inlined to keep the cache hit path free of allocations
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &c.shards[h%uint32(len(c.shards))]
+}
+
+// get returns the entry cached under key. The shard must be locked.
+func (s *cacheShard) get(key string) (*hostEntry, bool) {
+	e, ok := s.addrs[key]
+	return e, ok
+}
+
+// put caches e under key. The shard must be locked.
+func (s *cacheShard) put(key string, e *hostEntry) {
+	if s.addrs == nil {
+		s.addrs = map[string]*hostEntry{}
+	}
+	s.addrs[key] = e
+}
+
+func (c *hostCache) lockAll() {
+	c.init()
+	for i := range c.shards {
+		c.shards[i].mx.Lock()
+	}
+}
+
+func (c *hostCache) unlockAll() {
+	for i := range c.shards {
+		c.shards[i].mx.Unlock()
+	}
+}
+
+func (c *hostCache) rlockAll() {
+	c.init()
+	for i := range c.shards {
+		c.shards[i].mx.RLock()
+	}
+}
+
+func (c *hostCache) runlockAll() {
+	for i := range c.shards {
+		c.shards[i].mx.RUnlock()
+	}
+}
+
+// len returns how many entries are cached. All shards must be locked.
+func (c *hostCache) len() int {
+	n := 0
+	for i := range c.shards {
+		n += len(c.shards[i].addrs)
+	}
+	return n
+}
+
+// each calls fn for every cached entry until it returns false. All shards
+// must be locked.
+func (c *hostCache) each(fn func(key string, e *hostEntry) bool) {
+	for i := range c.shards {
+		for key, e := range c.shards[i].addrs {
+			if !fn(key, e) {
+				return
+			}
+		}
+	}
+}
+
+// reset drops every entry. All shards must be locked.
+func (c *hostCache) reset() {
+	for i := range c.shards {
+		c.shards[i].addrs = nil
+	}
+}
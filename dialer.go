@@ -1,169 +1,2449 @@
 package cdialer
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var defaultTTL = 1 * time.Hour
+const (
+	defaultTTL         = 1 * time.Hour
+	defaultNegativeTTL = 5 * time.Second
+)
+
+const (
+	probeIPv4Addr = "8.8.8.8:53"
+	probeIPv6Addr = "[2001:4860:4860::8888]:53"
+)
+
+var (
+	// ErrResolutionFailed is returned when the host couldn't be resolved
+	// to any address.
+	ErrResolutionFailed = errors.New("dialer: resolution failed")
+	// ErrAllAddrsUnreachable is returned when the host was resolved but
+	// every cached address failed to connect.
+	ErrAllAddrsUnreachable = errors.New("dialer: all addresses unreachable")
+	// ErrDialPanic is returned when the underlying dialer panicked and
+	// RecoverDialPanics is set.
+	ErrDialPanic = errors.New("dialer: underlying dial panicked")
+	// ErrAddrsBlocked is returned when every address a host resolved to
+	// was dropped by BlockPrivateIPs, DenyCIDRs or Filter.
+	ErrAddrsBlocked = errors.New("dialer: all resolved addresses are blocked")
+	// ErrMissingPort is returned when the address has no port and there's
+	// no DefaultPort to use.
+	ErrMissingPort = errors.New("dialer: missing port in address")
+	// ErrCNAMEChain is returned when following a host's CNAMEs went past
+	// MaxCNAMEDepth or came back to a name already seen.
+	ErrCNAMEChain = errors.New("dialer: bad CNAME chain")
+
+	errExcludesBothFamilies = errors.New("dialer: ExcludeIPv4 and ExcludeIPv6 are mutually exclusive")
+	errRemoteFiltered       = errors.New("dialer: address filters can't apply to hosts D resolves itself")
+)
+
+// dialError tags an underlying error with one of the sentinels above while
+// keeping it reachable through errors.Unwrap.
+type dialError struct {
+	kind error
+	err  error
+}
+
+func (e *dialError) Error() string        { return e.kind.Error() + ": " + e.err.Error() }
+func (e *dialError) Unwrap() error        { return e.err }
+func (e *dialError) Is(target error) bool { return target == e.kind }
+
+// DialError is returned when a dial tried several addresses and all of
+// them failed. Errs[i] is what dialing Addrs[i] failed with. Unwrap
+// exposes every one of those to errors.Is and errors.As.
+type DialError struct {
+	Addrs []string
+	Errs  []error
+}
+
+func (e *DialError) Error() string {
+	var b strings.Builder
+	for i, err := range e.Errs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(e.Addrs[i] + ": " + err.Error())
+	}
+	return b.String()
+}
+
+func (e *DialError) Unwrap() []error { return e.Errs }
+
+// joinDialErrors combines the errors of dialing each of addrs into a
+// DialError. A single failure is returned as is.
+func joinDialErrors(addrs []string, errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return &DialError{Addrs: addrs, Errs: errs}
+}
 
 type dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
 
+// Logger is implemented by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Resolver is implemented by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver is a Resolver that also reports the lowest TTL of the
+// records it looked up. The Dialer caches their addresses for that long
+// instead of for its TTL.
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// SRVResolver is a Resolver that can also look up SRV records, like
+// *net.Resolver.
+type SRVResolver interface {
+	Resolver
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// CNAMEResolver is a Resolver that can also look up the CNAME of a host,
+// a single hop of its chain, like DoHResolver and DoTResolver. It returns
+// host itself, or "", if there's none. *net.Resolver has the method too,
+// but returns the end of the chain at once.
+type CNAMEResolver interface {
+	Resolver
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// LookupIPFunc adapts a lookup function without a context, like
+// net.LookupIP, to a Resolver.
+type LookupIPFunc func(host string) ([]net.IP, error)
+
+func (f LookupIPFunc) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := f(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+// contextDialer is implemented by underlying dialers, like *net.Dialer,
+// that can abort a dial when its context is done.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 type Dialer struct {
-	D           dialer
+	D dialer
+
+	// Resolver looks hosts up, with the context of the dial that needs
+	// them. When nil, LookupIP is used if set, or else net.DefaultResolver.
+	Resolver    Resolver
 	LookupIP    func(host string) (ips []net.IP, err error)
 	TTL         time.Duration
 	ExcludeIPv6 bool
 
-	mx       sync.RWMutex
-	addrs    map[string][]string
-	idx      int64
+	// MinTTL and MaxTTL, when set, bound the record TTLs reported by a
+	// TTLResolver. They don't apply to TTL.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// TTLJitter spreads expiries out by randomly shortening or lengthening
+	// the TTL of every resolution by up to this fraction, 0.1 being ±10%,
+	// so that hosts resolved together aren't all re-resolved together.
+	TTLJitter float64
+
+	// ExcludeIPv4 is the counterpart of ExcludeIPv6 for IPv6-only
+	// networks. Setting both makes resolution fail. PreferIPv6 keeps both
+	// families but orders IPv6 addresses first.
+	ExcludeIPv4 bool
+	PreferIPv6  bool
+
+	// Strategy chooses which cached address to dial. When nil, addresses
+	// are rotated round-robin, which is the only mode RampUpNewAddrs
+	// applies to.
+	Strategy SelectionStrategy
+
+	// Affinity keeps dialing the address of a host that last connected
+	// until it fails, and only then goes back to Strategy.
+	Affinity bool
+
+	// AutoDetectFamily probes for working IPv4/IPv6 egress and drops
+	// addresses of a family that can't be reached. The probe is repeated
+	// every FamilyCheckInterval, or only once when the interval is zero.
+	AutoDetectFamily    bool
+	FamilyCheckInterval time.Duration
+	ProbeFamily         func(network string) bool
+
+	// RampUpNewAddrs over-weights addresses that appeared on re-resolution:
+	// a new address starts RampUpWeight times as likely to be picked and
+	// decays linearly to parity over RampUpWindow.
+	RampUpNewAddrs bool
+	RampUpWindow   time.Duration
+	RampUpWeight   int
+
+	// OnCacheHit and OnCacheMiss are called when a dial finds usable
+	// addresses cached for the host, or has to resolve it first.
+	// OnResolve is called after every lookup with the number of addresses
+	// it yielded and how long it took, and OnDial after every connection
+	// attempt. None of them is called with a lock held.
+	OnCacheHit  func(host string)
+	OnCacheMiss func(host string)
+	OnResolve   func(host string, addrs int, took time.Duration, err error)
+	OnDial      func(addr string, took time.Duration, err error)
+
+	// Tracer, if set, traces every dial in a span, with child spans for
+	// its lookup and each connection attempt.
+	Tracer Tracer
+
+	// Logger, if set, is told about evictions, resolutions and failures
+	// getting negatively cached.
+	Logger Logger
+
+	// OnForcedResolve is called when a host is re-resolved because all of
+	// its cached addresses were evicted, as opposed to TTL expiry.
+	OnForcedResolve func(host string)
+
+	// HealthyWhenEmpty is what Healthy and HostHealthy report for hosts
+	// that aren't cached at all.
+	HealthyWhenEmpty bool
+
+	// OnHostHealthChange is called when a host goes from having usable
+	// addresses to having none, and back. With a HealthDebounce the new
+	// state is only reported if it still holds once the debounce elapsed.
+	OnHostHealthChange func(host string, healthy bool)
+	HealthDebounce     time.Duration
+
+	// PreserveAddrOrder keeps addresses that survive a re-resolution in
+	// their cached order and appends new ones, instead of adopting the
+	// resolver's order wholesale.
+	PreserveAddrOrder bool
+
+	// InternAddrs makes identical cached address strings share storage
+	// across hosts, which saves memory when many hosts sit behind the same
+	// IPs. The pool keeps every distinct address it has seen.
+	InternAddrs bool
+
+	// NetworkRewrite, if set, maps the network passed to Dial to the one
+	// handed to the underlying dialer, e.g. to force "tcp" to "tcp4". The
+	// addresses dialed are resolved and cached for the rewritten network.
+	NetworkRewrite func(network string) string
+
+	// EvictOnErrorMatch decides whether a dial error evicts the address
+	// from the cache. By default every error does, except for context
+	// cancellation and timeouts, which say nothing about the address. See
+	// ErrorContains for classifying opaque errors by their message.
+	EvictOnErrorMatch func(err error) bool
+
+	// ShouldEvict, if set, replaces the whole classification of dial
+	// errors, including the one of EvictOnErrorMatch.
+	ShouldEvict func(err error) bool
+
+	// RetryCycle makes a failed Dial drop the host from the cache and go
+	// through resolution and dialing once more.
+	RetryCycle bool
+
+	// ExcludeSpecialUse drops loopback, link-local, unspecified and
+	// multicast addresses from resolution results.
+	ExcludeSpecialUse bool
+
+	// BlockPrivateIPs drops private (RFC 1918 and RFC 4193), loopback,
+	// link-local and unspecified addresses from resolution results, and
+	// DenyCIDRs those in any of the given networks. Unlike
+	// ExcludeSpecialUse they're meant as a guard against dialing internal
+	// services, so the resolved addresses are checked rather than the host
+	// name, which keeps DNS rebinding out. They, Filter and the family and
+	// special-use exclusions need hosts resolved locally, so dials through
+	// a D that resolves them itself, like a SOCKS5Proxy with
+	// RemoteResolve, fail when any is set.
+	BlockPrivateIPs bool
+	DenyCIDRs       []*net.IPNet
+
+	// Filter, if set, is called for every resolved IP and only the ones
+	// it returns true for are kept.
+	Filter func(ip net.IP) bool
+
+	// ReresolveOnEmpty makes a dial that evicted the last cached address of
+	// a host resolve it again before returning, so that the next dial has
+	// addresses to try right away.
+	ReresolveOnEmpty bool
+
+	// EvictCooldown, if set, puts evicted addresses back in rotation once
+	// it elapsed, instead of only when the host is resolved again.
+	EvictCooldown time.Duration
+
+	// RecoverDialPanics turns a panic in the underlying dialer into an
+	// ErrDialPanic error and evicts the address that was being dialed.
+	RecoverDialPanics bool
+
+	// MinResolveInterval limits how often a single host may be resolved,
+	// whatever prompted it. In between, the cached addresses and the last
+	// resolution error are reused.
+	MinResolveInterval time.Duration
+
+	// MaxLookupsPerSecond caps the rate of lookups across all hosts, to
+	// spare the resolver when many entries expire at once. Hosts with
+	// stale addresses keep using them while the limit is reached; the
+	// others wait for their turn, for as long as the dial's context lets
+	// them.
+	MaxLookupsPerSecond float64
+
+	// ShuffleOnResolve puts resolved addresses in random order, so that
+	// processes starting at the same time don't all dial the first one.
+	// With PreferIPv6 each family is shuffled on its own.
+	ShuffleOnResolve bool
+
+	// SortAddrs puts resolved addresses in IP order, IPv4 ones first,
+	// instead of the resolver's, so that dials pick the same ones whatever
+	// order the records came in. It overrides ShuffleOnResolve.
+	SortAddrs bool
+
+	// MaxAddrs caps how many of a host's resolved addresses are cached,
+	// keeping the first ones after ordering and shuffling. Zero means no
+	// limit.
+	MaxAddrs int
+
+	// NegativeTTL is how long a failed resolution is remembered. Until it
+	// elapses dials of the host fail with the same error without querying
+	// the resolver again. Zero disables negative caching.
+	NegativeTTL time.Duration
+
+	// StaleWhileRevalidate makes dials of a host whose entry expired use
+	// the stale addresses right away while a single background refresh
+	// of the host runs.
+	StaleWhileRevalidate bool
+
+	// RefreshInterval is how often the background refresh launched by
+	// Start runs. Every run re-resolves the hosts that would expire before
+	// the next one. Defaults to a tenth of the TTL.
+	RefreshInterval time.Duration
+
+	// MaxAttempts caps how many cached addresses a single dial tries
+	// before giving up. Zero means all of them.
+	MaxAttempts int
+
+	// MaxConcurrentDials caps how many connection attempts are in flight
+	// at once across all hosts. Attempts past it wait for a slot, for as
+	// long as the dial's context lets them. Changing it after the first
+	// dial has no effect.
+	MaxConcurrentDials int
+
+	// PrecheckTimeout, when set, makes every resolution probe the
+	// addresses it found with a TCP connect bounded by it, and cache only
+	// those that accepted, or all of them if none did. It delays the dials
+	// waiting on the resolution, so it suits hosts refreshed in the
+	// background best, with Start or StaleWhileRevalidate.
+	PrecheckTimeout time.Duration
+
+	// BreakerThreshold, when set, opens the circuit breaker of an address
+	// after that many consecutive failed attempts: dials skip it until
+	// BreakerReset elapsed, then let a single one try it again, which
+	// closes the breaker if it connects and opens it again otherwise.
+	// Breakers outlive resolutions, unlike evictions. Dials of hosts whose
+	// addresses all have their breaker open fail right away with
+	// ErrAllAddrsUnreachable, and Healthy and HostHealthy don't count
+	// them. With the default ShouldEvict most errors evict the address on
+	// the first failure, so thresholds over 1 only matter for those that
+	// don't, like timeouts, unless ShouldEvict keeps more addresses.
+	BreakerThreshold int
+	// BreakerReset is how long a breaker stays open, 30s when zero.
+	BreakerReset time.Duration
+
+	// DialTimeout bounds every single address attempt, on top of the
+	// deadline of the dial's context, so that one unresponsive address
+	// leaves time for the next ones. It only applies to underlying
+	// dialers with a DialContext method.
+	DialTimeout time.Duration
+
+	// LocalAddr is the local address connections are made from, for hosts
+	// that must egress through a specific interface. It's only honored
+	// when D is a *net.Dialer; other dialers dial as they're configured.
+	LocalAddr net.Addr
+
+	// TLSConfig is what DialTLSContext handshakes with.
+	TLSConfig *tls.Config
+
+	// ProxyProtocol, when 1 or 2, makes every connection start with a
+	// PROXY protocol header of that version, sent before it's returned.
+	// The header carries the addresses ProxyAddrs returns for the dial's
+	// context, or else the connection's own. A nil source makes it an
+	// UNKNOWN (v1) or LOCAL (v2) one.
+	ProxyProtocol int
+	ProxyAddrs    func(ctx context.Context, conn net.Conn) (src, dst net.Addr)
+
+	// SRV resolves hosts named like "_service._proto.name", dialed without
+	// a port, through their SRV records: the targets' addresses are dialed
+	// on the ports the records name. Targets with the lowest priority
+	// value are used first and only once they're all evicted are the next
+	// ones; the weights order targets of equal priority at every
+	// resolution. The records are looked up through the Resolver if it's
+	// an SRVResolver, or else net.DefaultResolver.
+	SRV bool
+
+	// DefaultPort is the port dialed when the address has none, like
+	// "localhost". Without it such dials fail with ErrMissingPort.
+	DefaultPort string
+
+	// MaxCNAMEDepth, when set and the Resolver is a CNAMEResolver, makes
+	// lookups follow CNAMEs one at a time, at most that many, before
+	// looking up the addresses of the last name. Longer chains and loops
+	// fail with ErrCNAMEChain. What's found is cached under the name
+	// dialed. It has no use with a *net.Resolver, which never reports
+	// more than one CNAME.
+	MaxCNAMEDepth int
+
+	// ConnectTimeout and KeepAlive configure the *net.Dialer made at the
+	// first dial when D is nil, as its Timeout and KeepAlive. A D that's set
+	// is used as is.
+	ConnectTimeout time.Duration
+	KeepAlive      time.Duration
+
+	// Store, when set, shares resolutions with the other Dialers using
+	// the same one: hosts are looked up there before they're resolved, and
+	// what gets resolved is put there for as long as it's cached. Rotation
+	// and evictions stay with each Dialer, and so do Flush and
+	// InvalidateOnNetworkChange, while Evict drops the host from the Store
+	// too. Addresses found in the Store go through the Dialer's own
+	// filters, like those it resolves.
+	Store Cache
+
+	// HappyEyeballs races the cached addresses, alternating IP families,
+	// as described in RFC 8305: the next address is dialed when the
+	// previous one failed or hasn't connected within FallbackDelay
+	// (300ms when zero). The first connection wins and the rest are
+	// cancelled or closed.
+	HappyEyeballs bool
+	FallbackDelay time.Duration
+
+	addrs hostCache
+	mx    sync.RWMutex // guards everything but the host cache
+
+	familyMx      sync.Mutex
+	hasIPv4       bool
+	hasIPv6       bool
+	familyChecked time.Time
+
+	flights flightGroup
+
+	firstSeen map[string]map[string]time.Time
+
+	forcedResolves int64
+	addrSetChanges int64
+	resolves       int64
+	cacheHits      int64
+	cacheMisses    int64
+	dialSuccesses  int64
+	dialFailures   int64
+	evictions      int64
+	addrSets       map[string]addrSet
+
+	healthMx     sync.Mutex
+	reportedDown map[string]bool
+	healthTimers map[string]*time.Timer
+
+	interned internPool
+
+	lastResolve map[string]resolveResult
+
+	// hostIPs has the addresses looked up for each host name, so that
+	// dials of its other ports reuse them
+	hostIPs map[string]hostIPs
+
+	limiter   lookupLimiter
+	dialSlots dialSemaphore
+
+	jitterRand func() float64 // rand.Float64 when nil
+
+	lifeMx  sync.Mutex
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// hostEntry is the cached state of a single host.
+type hostEntry struct {
+	addrs    []string
+	resolved time.Time
+	idx      int64         // round-robin position, updated atomically
+	ttl      time.Duration // record TTL, zero when the resolver didn't tell
+	jitter   float64       // TTLJitter share applied to this resolution
+
+	failed  time.Time // when resolution last failed, zero after a success
+	failErr error
+
+	refreshing int32 // set while a background refresh runs
+
+	cooling []cooldown // evicted addresses waiting for EvictCooldown
+
+	lastGood atomic.Value // string, the address that last connected
+
+	prio atomic.Value // map[string]uint16, SRV priority of each address
+
+	breakerMx sync.Mutex
+	breakers  map[string]*breaker // per address, for BreakerThreshold
+}
+
+type cooldown struct {
+	addr  string
+	until time.Time
+}
+
+type resolveResult struct {
+	at  time.Time
+	err error
+}
+
+// hostIPs is what looking a host name up found, before filtering and
+// without a port.
+type hostIPs struct {
+	ips      []net.IPAddr
+	ttl      time.Duration // record TTL, zero when the resolver didn't tell
 	resolved time.Time
 }
 
+// internPool deduplicates strings. It's safe for concurrent use.
+type internPool struct {
+	mx   sync.Mutex
+	strs map[string]string
+}
+
+func (p *internPool) intern(s string) string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if v, ok := p.strs[s]; ok {
+		return v
+	}
+	if p.strs == nil {
+		p.strs = map[string]string{}
+	}
+	p.strs[s] = s
+	return s
+}
+
+// Stats is a point-in-time copy of the Dialer's counters.
+type Stats struct {
+	ForcedResolves int64
+	// AddrSetChanges counts re-resolutions, across all hosts, that
+	// returned a different address set than the previous one.
+	AddrSetChanges int64
+
+	// Resolves counts lookups, failed ones included. Dials that waited on
+	// another dial's lookup don't add to it.
+	Resolves    int64
+	CacheHits   int64
+	CacheMisses int64
+	// DialSuccesses and DialFailures count Dial calls, not connection
+	// attempts, and Evictions the addresses dropped after failing.
+	DialSuccesses int64
+	DialFailures  int64
+	Evictions     int64
+}
+
+// addrSet is an order-independent fingerprint of a host's resolved
+// addresses along with how many times it changed.
+type addrSet struct {
+	hash    uint64
+	changes int64
+}
+
+const rampUpScale = 100
+
+// DefaultTTL returns the TTL Wrap configures.
+func DefaultTTL() time.Duration {
+	return defaultTTL
+}
+
+// Wrap returns a Dialer with default settings dialing through d. The
+// package keeps no mutable global state, so every Dialer, whether made by
+// Wrap, NewDialer or as a zero value, starts from a pristine cache.
 func Wrap(d dialer) *Dialer {
-	return &Dialer{D: d, TTL: defaultTTL}
+	return NewDialer(WithDialer(d))
 }
 
 func (d *Dialer) Dial(network, host string) (net.Conn, error) {
-	addrs, err := d.getAddrs(host)
+	return d.DialContext(context.Background(), network, host)
+}
+
+// DialContext is like Dial but gives up as soon as ctx is done. The context
+// is passed on to the underlying dialer if it has a DialContext method.
+func (d *Dialer) DialContext(ctx context.Context, network, host string) (net.Conn, error) {
+	conn, _, err := d.DialContextAddr(ctx, network, host)
+	return conn, err
+}
+
+// Attempt is one connection attempt of a dial.
+type Attempt struct {
+	Addr  string
+	Start time.Time
+	Took  time.Duration
+	Err   error
+}
+
+// DialContextTrace is like DialContext but also returns the connection
+// attempts the dial made, in the order they started. With HappyEyeballs
+// those still running when another one won are left out.
+func (d *Dialer) DialContextTrace(ctx context.Context, network, host string) (net.Conn, []Attempt, error) {
+	log := &attemptLog{}
+	conn, _, err := d.DialContextAddr(context.WithValue(ctx, attemptLogKey{}, log), network, host)
+
+	log.mx.Lock()
+	attempts := log.attempts
+	log.attempts = nil // attempts still running once the dial returned aren't kept
+	log.mx.Unlock()
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].Start.Before(attempts[j].Start) })
+	return conn, attempts, err
+}
+
+type attemptLogKey struct{}
+
+type attemptLog struct {
+	mx       sync.Mutex
+	attempts []Attempt
+}
+
+// DialContextAddr is like DialContext but also returns the address that
+// the connection was made to.
+func (d *Dialer) DialContextAddr(ctx context.Context, network, host string) (conn net.Conn, addr string, err error) {
+	ctx, span := d.startSpan(ctx, "cdialer.Dial")
+	if span != nil {
+		var attempts int32
+		ctx = withAttemptCount(ctx, &attempts)
+		span.SetAttribute("cdialer.host", host)
+		defer endSpan(span, &err)
+		defer func() { // before endSpan
+			span.SetAttribute("cdialer.addr", addr)
+			span.SetAttribute("cdialer.attempts", int(atomic.LoadInt32(&attempts)))
+		}()
+	}
+
+	host, err = d.withPort(host)
 	if err != nil {
-		return nil, err
+		atomic.AddInt64(&d.dialFailures, 1)
+		return nil, "", err
+	}
+	if d.NetworkRewrite != nil {
+		network = d.NetworkRewrite(network)
+	}
+
+	conn, addr, err = d.dial(ctx, network, host)
+	if err != nil && d.RetryCycle && ctx.Err() == nil {
+		key := cacheKey(network, host)
+		if d.Store != nil {
+			d.Store.Delete(key)
+		}
+		s := d.addrs.shard(key)
+		s.mx.Lock()
+		delete(s.addrs, key)
+		d.mx.Lock()
+		d.forgetHostIPs(key)
+		d.mx.Unlock()
+		s.mx.Unlock()
+
+		// a failed or throttled re-resolution says less than the dial error
+		retryConn, retryAddr, retryErr := d.dial(ctx, network, host)
+		if !errors.Is(retryErr, ErrResolutionFailed) {
+			conn, addr, err = retryConn, retryAddr, retryErr
+		}
+	}
+	if err == nil && d.ProxyProtocol != 0 {
+		if err = d.writeProxyHeader(ctx, conn); err != nil {
+			conn.Close()
+			conn, addr = nil, ""
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&d.dialFailures, 1)
+	} else {
+		atomic.AddInt64(&d.dialSuccesses, 1)
+	}
+	return conn, addr, err
+}
+
+func (d *Dialer) dial(ctx context.Context, network, host string) (net.Conn, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	d.initDialer()
+	key := cacheKey(network, host)
+	if isIPLiteral(host) {
+		return d.dialLiteral(ctx, network, key)
+	}
+	if rd, ok := d.D.(remoteResolver); ok && rd.resolvesRemotely() {
+		return d.dialRemote(ctx, network, host)
+	}
+
+	e, addrs, err := d.getAddrs(ctx, key)
+	if err != nil {
+		return nil, "", &dialError{ErrResolutionFailed, err}
 	}
 
 	if len(addrs) == 0 {
-		return nil, errors.New(`dialer: can't resolve host "` + host + `"`)
+		err = errors.New(`can't resolve host "` + host + `"`)
+		return nil, "", &dialError{ErrResolutionFailed, err}
 	}
 
-	idx := atomic.AddInt64(&d.idx, 1)
-	addr := addrs[int(idx)%len(addrs)]
+	addr := d.pick(e, key, host, addrs)
 
-	conn, err := d.D.Dial(network, addr)
-	if err != nil { // remove IP from the cache
-		d.mx.Lock()
-		var ok bool
-		addrs, ok = d.addrs[host]
-		if !ok || len(addrs) == 0 {
-			d.mx.Unlock()
-			return conn, err
-		}
-
-		index := 0
-		found := false
-		for i, a := range addrs {
-			if a == addr {
-				index = i
-				found = true
-				break
-			}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if d.HappyEyeballs && len(addrs) > 1 {
+		return d.dialParallel(ctx, network, e, key, addr, addrs)
+	}
+
+	attempts := len(addrs)
+	if d.MaxAttempts > 0 && d.MaxAttempts < attempts {
+		attempts = d.MaxAttempts
+	}
+
+	// go on from the picked address through the rest of the snapshot,
+	// which evictions don't modify
+	start := 0
+	for i, a := range addrs {
+		if a == addr {
+			start = i
+			break
 		}
-		if found {
-			addrs2 := make([]string, len(addrs)-1)
-			copy(addrs2[:index], addrs[:index])
-			copy(addrs2[index:], addrs[index+1:])
-			d.addrs[host] = addrs2
+	}
+	if prio, _ := e.prio.Load().(map[string]uint16); prio != nil {
+		// lower priorities only once the picked one's are all tried
+		n := topPriority(prio, addrs)
+		if start < n {
+			ordered := make([]string, 0, len(addrs))
+			ordered = append(ordered, addrs[start:n]...)
+			ordered = append(ordered, addrs[:start]...)
+			addrs, start = append(ordered, addrs[n:]...), 0
 		}
-		d.mx.Unlock()
 	}
 
-	return conn, err
+	var failed []string
+	var errs []error
+	remaining := len(addrs)
+	tried := 0
+	for i := 0; i < len(addrs) && tried < attempts; i++ {
+		addr := addrs[(start+i)%len(addrs)]
+		if !d.breakerAllows(e, addr, time.Now()) {
+			continue
+		}
+		attemptCtx, cancel := attemptContext(ctx, attempts-tried)
+		tried++
+		conn, err := d.timedDial(attemptCtx, network, addr)
+		cancel()
+		d.noteResult(e, addr, err)
+		if err == nil {
+			return conn, addr, nil
+		}
+
+		failed = append(failed, addr)
+		errs = append(errs, err)
+		if d.shouldEvict(err) {
+			remaining = d.evictAddr(key, addr, err)
+		}
+		if remaining == 0 || ctx.Err() != nil {
+			break
+		}
+	}
+	if tried == 0 {
+		return nil, "", errBreakersOpen(key)
+	}
+
+	err = joinDialErrors(failed, errs)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, "", &dialError{ctxErr, err}
+	}
+	if remaining == 0 {
+		if d.ReresolveOnEmpty {
+			d.reresolve(ctx, key)
+		}
+		return nil, "", &dialError{ErrAllAddrsUnreachable, err}
+	}
+	return nil, "", err
 }
 
-func (d *Dialer) getAddrs(address string) ([]string, error) {
-	now := time.Now()
-	if now.Sub(d.resolved) > d.TTL {
-		d.mx.Lock()
+// minAttemptTime is the least time attemptContext gives an attempt, as
+// long as the deadline allows.
+const minAttemptTime = 2 * time.Second
 
-		var addrs []string
-		var err error
+// attemptContext returns a context for the next of n attempts left, with
+// an even share of the time left until ctx's deadline, if it has one.
+func attemptContext(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || n <= 1 {
+		return ctx, func() {}
+	}
+	left := time.Until(deadline)
+	share := left / time.Duration(n)
+	if share < minAttemptTime {
+		share = minAttemptTime
+	}
+	if share >= left {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, share)
+}
 
-		if now.Sub(d.resolved) <= d.TTL {
-			list, ok := d.addrs[address]
-			if ok && len(addrs) > 0 {
-				addrs = list
-			}
-		}
+// noteResult tracks the address of e that last connected for Affinity,
+// and the state of its breaker.
+func (d *Dialer) noteResult(e *hostEntry, addr string, err error) {
+	d.noteBreaker(e, addr, err, time.Now())
+	if !d.Affinity {
+		return
+	}
+	if err != nil {
+		e.lastGood.CompareAndSwap(addr, "")
+	} else if last, _ := e.lastGood.Load().(string); last != addr {
+		e.lastGood.Store(addr)
+	}
+}
+
+// reresolve resolves the host cached under key again if all of its
+// addresses were evicted.
+func (d *Dialer) reresolve(ctx context.Context, key string) {
+	s := d.addrs.shard(key)
+	s.mx.RLock()
+	e, ok := s.get(key)
+	empty := ok && len(e.addrs) == 0
+	s.mx.RUnlock()
+	if !empty {
+		return
+	}
+
+	addrs, ev, err := d.updateAddrs(ctx, key)
+	d.noteResolve(ev)
+	if !ev.done {
+		return
+	}
+	atomic.AddInt64(&d.forcedResolves, 1)
+	if d.OnForcedResolve != nil {
+		d.OnForcedResolve(key)
+	}
+	if err == nil {
+		d.noteHealth(key, len(addrs) > 0)
+	}
+}
 
-		if len(addrs) == 0 {
-			addrs, err = d.updateAddrs(address)
+// ttl returns how long e stays fresh.
+func (d *Dialer) ttl(e *hostEntry) time.Duration {
+	ttl := e.ttl
+	if ttl <= 0 {
+		ttl = d.TTL
+	} else {
+		if d.MinTTL > 0 && ttl < d.MinTTL {
+			ttl = d.MinTTL
+		}
+		if d.MaxTTL > 0 && ttl > d.MaxTTL {
+			ttl = d.MaxTTL
 		}
+	}
+	if e.jitter != 0 {
+		ttl = time.Duration(float64(ttl) * (1 + e.jitter))
+	}
+	return ttl
+}
 
-		d.mx.Unlock()
-		return addrs, err
+// newJitter returns the share of TTLJitter for a new resolution.
+func (d *Dialer) newJitter() float64 {
+	if d.TTLJitter <= 0 {
+		return 0
+	}
+	rnd := d.jitterRand
+	if rnd == nil {
+		rnd = rand.Float64
 	}
+	return d.TTLJitter * (2*rnd() - 1)
+}
 
-	d.mx.RLock()
-	addrs, ok := d.addrs[address]
-	d.mx.RUnlock()
+// evictAddr removes addr, which failed with err, from the entry cached
+// under key and returns how many addresses are left.
+func (d *Dialer) evictAddr(key, addr string, err error) int {
+	s := d.addrs.shard(key)
+	s.mx.Lock()
+	e, ok := s.get(key)
+	if !ok || len(e.addrs) == 0 {
+		s.mx.Unlock()
+		return 0
+	}
+	addrs := e.addrs
 
-	if !ok || len(addrs) == 0 {
-		d.mx.Lock()
-		if addrs, ok = d.addrs[address]; !ok || len(addrs) == 0 {
-			list, err := d.updateAddrs(address)
-			if err != nil {
-				d.mx.Unlock()
-				return nil, err
-			}
-			addrs = list
+	index := 0
+	found := false
+	for i, a := range addrs {
+		if a == addr {
+			index = i
+			found = true
+			break
 		}
+	}
+	if found {
+		addrs2 := make([]string, len(addrs)-1)
+		copy(addrs2[:index], addrs[:index])
+		copy(addrs2[index:], addrs[index+1:])
+		e.addrs = addrs2
+		addrs = addrs2
 
-		d.mx.Unlock()
+		if d.EvictCooldown > 0 {
+			e.cooling = append(e.cooling, cooldown{addr, time.Now().Add(d.EvictCooldown)})
+		}
 	}
+	s.mx.Unlock()
 
-	return addrs, nil
+	if found {
+		atomic.AddInt64(&d.evictions, 1)
+		d.logf("cdialer: removed %s for host %s: %v", addr, key, err)
+	}
+	if found && len(addrs) == 0 {
+		d.noteHealth(key, false)
+	}
+	return len(addrs)
 }
 
-func (d *Dialer) updateAddrs(address string) ([]string, error) {
-	addrs, err := d.resolve(address)
-	if err != nil {
-		return nil, err
+// requeue puts the addresses of e whose cooldown is over back in rotation
+// and returns the current ones.
+func (e *hostEntry) requeue(now time.Time) []string {
+	addrs := e.addrs[:len(e.addrs):len(e.addrs)] // appending must copy
+	cooling := e.cooling[:0]
+	for _, c := range e.cooling {
+		if now.Before(c.until) {
+			cooling = append(cooling, c)
+		} else if !contains(addrs, c.addr) {
+			addrs = append(addrs, c.addr)
+		}
 	}
+	e.cooling = cooling
+	e.addrs = addrs
+	return addrs
+}
 
-	if d.addrs == nil {
-		d.addrs = map[string][]string{}
+// cooledDown reports whether any of the evicted addresses of e may be
+// dialed again.
+func (e *hostEntry) cooledDown(now time.Time) bool {
+	for _, c := range e.cooling {
+		if !now.Before(c.until) {
+			return true
+		}
 	}
-	d.addrs[address] = addrs
-	d.resolved = time.Now()
+	return false
+}
 
-	if d.D == nil {
-		d.D = &net.Dialer{}
+// withoutCooling drops the addresses still cooling down from freshly
+// resolved addrs, unless none would be left, and forgets those the host
+// no longer resolves to.
+func (e *hostEntry) withoutCooling(addrs []string, now time.Time) []string {
+	if len(e.cooling) == 0 {
+		return addrs
 	}
 
-	return addrs, nil
-}
+	cooling := e.cooling[:0]
+	for _, c := range e.cooling {
+		if now.Before(c.until) && contains(addrs, c.addr) {
+			cooling = append(cooling, c)
+		}
+	}
+	e.cooling = cooling
 
-func (d *Dialer) resolve(address string) ([]string, error) {
-	host, port, err := net.SplitHostPort(address)
-	if err != nil {
-		return nil, err
+	var kept []string
+	for _, a := range addrs {
+		if !e.isCooling(a) {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == 0 {
+		e.cooling = nil
+		return addrs
 	}
+	return kept
+}
 
-	if d.LookupIP == nil {
-		d.LookupIP = net.LookupIP
+func (e *hostEntry) isCooling(addr string) bool {
+	for _, c := range e.cooling {
+		if c.addr == addr {
+			return true
+		}
 	}
+	return false
+}
 
-	ips, err := d.LookupIP(host)
-	if err != nil {
-		return nil, err
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
 	}
+	return false
+}
 
-	addrs := make([]string, 0, len(ips))
-	for _, ip := range ips {
-		addr := ip.String()
+const (
+	ipv4KeyPrefix = "ip4/"
+	ipv6KeyPrefix = "ip6/"
+)
 
-		if d.ExcludeIPv6 {
-			if strings.IndexRune(addr, ':') > -1 {
-				continue
-			}
-		}
+// cacheKey returns the cache key for dialing address over network. Dials
+// restricted to one IP family, like "tcp4" or "udp6", get entries of their
+// own that only hold addresses of that family.
+func cacheKey(network, address string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ipv4KeyPrefix + address
+	case strings.HasSuffix(network, "6"):
+		return ipv6KeyPrefix + address
+	}
+	return address
+}
 
-		addrs = append(addrs, "["+addr+"]:"+port)
+// splitCacheKey is the reverse of cacheKey. It reports which families the
+// entry may hold along with the address to resolve.
+func splitCacheKey(key string) (ipv4, ipv6 bool, address string) {
+	switch {
+	case strings.HasPrefix(key, ipv4KeyPrefix):
+		return true, false, key[len(ipv4KeyPrefix):]
+	case strings.HasPrefix(key, ipv6KeyPrefix):
+		return false, true, key[len(ipv6KeyPrefix):]
+	}
+	return true, true, key
+}
+
+// timedDial is dialAddr reporting to OnDial, the Tracer and
+// DialContextTrace.
+func (d *Dialer) timedDial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if d.Tracer != nil {
+		var span Span
+		countAttempt(ctx)
+		ctx, span = d.startSpan(ctx, "cdialer.connect")
+		span.SetAttribute("cdialer.addr", addr)
+		defer endSpan(span, &err)
+	}
+
+	if d.MaxConcurrentDials > 0 {
+		if err := d.dialSlots.acquire(ctx, d.MaxConcurrentDials); err != nil {
+			return nil, err
+		}
+		defer d.dialSlots.release()
+	}
+
+	log, _ := ctx.Value(attemptLogKey{}).(*attemptLog)
+	if d.OnDial == nil && log == nil {
+		return d.connect(ctx, network, addr)
+	}
+	start := time.Now()
+	conn, err = d.connect(ctx, network, addr)
+	took := time.Since(start)
+	if d.OnDial != nil {
+		d.OnDial(addr, took, err)
+	}
+	if log != nil {
+		log.mx.Lock()
+		log.attempts = append(log.attempts, Attempt{addr, start, took, err})
+		log.mx.Unlock()
+	}
+	return conn, err
+}
+
+type handshakeKey struct{}
+
+// handshake is what a Dialer does on every connection it makes for a
+// dial, e.g. the CONNECT of a ConnectProxy, as part of the attempt.
+type handshake struct {
+	d  *Dialer
+	fn func(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+// withHandshake returns ctx making d's dials for it run fn on their
+// connections, so that fn failing fails the attempt. The dials of other
+// Dialers for it, like those of a proxy D, don't.
+func (d *Dialer) withHandshake(ctx context.Context, fn func(ctx context.Context, conn net.Conn) (net.Conn, error)) context.Context {
+	return context.WithValue(ctx, handshakeKey{}, &handshake{d, fn})
+}
+
+// connect is dialAddr followed by the handshake of ctx, if any.
+func (d *Dialer) connect(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialAddr(ctx, network, addr)
+	h, ok := ctx.Value(handshakeKey{}).(*handshake)
+	if err != nil || !ok || h.d != d {
+		return conn, err
+	}
+	hconn, err := h.fn(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return hconn, nil
+}
+
+func (d *Dialer) dialAddr(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if d.RecoverDialPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				perr, ok := r.(error)
+				if !ok {
+					perr = fmt.Errorf("%v", r)
+				}
+				conn, err = nil, &dialError{ErrDialPanic, perr}
+			}
+		}()
+	}
+	dd := d.D
+	if nd, ok := dd.(*net.Dialer); ok && d.LocalAddr != nil {
+		bound := *nd
+		bound.LocalAddr = d.LocalAddr
+		dd = &bound
+	}
+	if cd, ok := dd.(contextDialer); ok {
+		if d.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.DialTimeout)
+			defer cancel()
+		}
+		return cd.DialContext(ctx, network, addr)
+	}
+	return dd.Dial(network, addr)
+}
+
+func (d *Dialer) shouldEvict(err error) bool {
+	if d.ShouldEvict != nil {
+		return d.ShouldEvict(err)
+	}
+	if errors.Is(err, ErrDialPanic) {
+		return true
+	}
+	if isTransient(err) {
+		return false
+	}
+	if d.EvictOnErrorMatch != nil {
+		return d.EvictOnErrorMatch(err)
+	}
+	return true
+}
+
+// isTransient reports whether err is a cancellation or timeout rather than
+// a sign that the address is unreachable.
+func isTransient(err error) bool {
+	if isContextErr(err) {
+		return true
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// ErrorContains returns an EvictOnErrorMatch matcher reporting true for
+// errors whose message contains any of substrs.
+func ErrorContains(substrs ...string) func(err error) bool {
+	return func(err error) bool {
+		msg := err.Error()
+		for _, s := range substrs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SetTTL changes the TTL at runtime without dropping the cache. Cached
+// entries are checked against the new TTL the next time they're used.
+func (d *Dialer) SetTTL(ttl time.Duration) {
+	d.addrs.lockAll()
+	d.mx.Lock()
+	d.TTL = ttl
+	d.mx.Unlock()
+	d.addrs.unlockAll()
+}
+
+// InvalidateOnNetworkChange drops every cached address so the following
+// dials re-resolve on the new network. Wire it to the platform's
+// connectivity callback.
+func (d *Dialer) InvalidateOnNetworkChange() {
+	d.addrs.lockAll()
+	d.addrs.reset()
+	d.mx.Lock()
+	d.firstSeen = nil
+	d.lastResolve = nil
+	d.hostIPs = nil
+	d.mx.Unlock()
+	d.addrs.unlockAll()
+
+	d.familyMx.Lock()
+	d.familyChecked = time.Time{}
+	d.familyMx.Unlock()
+}
+
+// CacheEntry is a copy of what's cached for a host.
+type CacheEntry struct {
+	Addrs    []string
+	Resolved time.Time
+	// TTL is how long the entry stays fresh, zero once it expired.
+	TTL time.Duration
+}
+
+// Snapshot returns a copy of the cache keyed by "host:port". Entries of
+// dials restricted to one IP family are keyed "ip4/host:port" and
+// "ip6/host:port".
+func (d *Dialer) Snapshot() map[string]CacheEntry {
+	now := time.Now()
+
+	d.addrs.rlockAll()
+	defer d.addrs.runlockAll()
+
+	snap := make(map[string]CacheEntry, d.addrs.len())
+	d.addrs.each(func(key string, e *hostEntry) bool {
+		ttl := e.resolved.Add(d.ttl(e)).Sub(now)
+		if ttl < 0 {
+			ttl = 0
+		}
+		snap[key] = CacheEntry{
+			Addrs:    append([]string(nil), e.addrs...),
+			Resolved: e.resolved,
+			TTL:      ttl,
+		}
+		return true
+	})
+	return snap
+}
+
+// Flush drops every cached entry. Unlike InvalidateOnNetworkChange it
+// keeps the IP family detection results.
+func (d *Dialer) Flush() {
+	d.addrs.lockAll()
+	d.addrs.reset()
+	d.mx.Lock()
+	d.firstSeen = nil
+	d.lastResolve = nil
+	d.hostIPs = nil
+	d.mx.Unlock()
+	d.addrs.unlockAll()
+}
+
+// Evict drops the entries cached for host, including those of dials
+// restricted to one IP family, and reports whether there were any.
+func (d *Dialer) Evict(host string) bool {
+	keys := []string{host, ipv4KeyPrefix + host, ipv6KeyPrefix + host}
+	if d.Store != nil {
+		for _, key := range keys {
+			d.Store.Delete(key)
+		}
+	}
+
+	d.addrs.lockAll()
+	defer d.addrs.unlockAll()
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	found := false
+	for _, key := range keys {
+		s := d.addrs.shard(key)
+		if _, ok := s.get(key); ok {
+			delete(s.addrs, key)
+			found = true
+		}
+		delete(d.firstSeen, key)
+		delete(d.lastResolve, key)
+		d.forgetHostIPs(key)
+	}
+	return found
+}
+
+func (d *Dialer) Stats() Stats {
+	return Stats{
+		ForcedResolves: atomic.LoadInt64(&d.forcedResolves),
+		AddrSetChanges: atomic.LoadInt64(&d.addrSetChanges),
+		Resolves:       atomic.LoadInt64(&d.resolves),
+		CacheHits:      atomic.LoadInt64(&d.cacheHits),
+		CacheMisses:    atomic.LoadInt64(&d.cacheMisses),
+		DialSuccesses:  atomic.LoadInt64(&d.dialSuccesses),
+		DialFailures:   atomic.LoadInt64(&d.dialFailures),
+		Evictions:      atomic.LoadInt64(&d.evictions),
+	}
+}
+
+// ChangeCount returns how many times re-resolving host produced a
+// different address set. A high count points at unstable DNS answers.
+func (d *Dialer) ChangeCount(host string) int64 {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return d.addrSets[host].changes
+}
+
+// Validate resolves host and applies all of the address filters, returning
+// what would be cached without touching the cache.
+func (d *Dialer) Validate(ctx context.Context, host string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	addrs, err := d.resolve(ctx, host)
+	d.noteResolve(resolveEvent{host: host, addrs: len(addrs), took: time.Since(start), err: err, done: true})
+
+	if err != nil {
+		return nil, &dialError{ErrResolutionFailed, err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		err = errors.New(`can't resolve host "` + host + `"`)
+		return nil, &dialError{ErrResolutionFailed, err}
 	}
 	return addrs, nil
 }
+
+// AddrsMatch compares the addresses host resolves to, cached or freshly
+// resolved, against expected. Expected entries may be bare IPs or
+// host:port pairs; only the IPs are compared. missing lists the expected
+// entries that aren't cached and extra the cached addresses that weren't
+// expected.
+func (d *Dialer) AddrsMatch(host string, expected []string) (ok bool, missing, extra []string, err error) {
+	_, addrs, err := d.getAddrs(context.Background(), host)
+	if err != nil {
+		return false, nil, nil, &dialError{ErrResolutionFailed, err}
+	}
+
+	want := make(map[string]bool, len(expected))
+	for _, e := range expected {
+		want[addrIP(e)] = true
+	}
+	have := make(map[string]bool, len(addrs))
+	for _, a := range addrs {
+		ip := addrIP(a)
+		have[ip] = true
+		if !want[ip] {
+			extra = append(extra, a)
+		}
+	}
+	for _, e := range expected {
+		if !have[addrIP(e)] {
+			missing = append(missing, e)
+		}
+	}
+
+	return len(missing) == 0 && len(extra) == 0, missing, extra, nil
+}
+
+// addrIP returns the canonical IP of an "ip" or "ip:port" string.
+func addrIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if ip, ok := parseIPZone(strings.Trim(addr, "[]")); ok {
+		return ip.String()
+	}
+	return addr
+}
+
+// sortAddrs sorts "[ip]:port" addresses by IP, IPv4 ones first.
+func sortAddrs(addrs []string) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		a, _ := parseIPZone(addrIP(addrs[i]))
+		b, _ := parseIPZone(addrIP(addrs[j]))
+		if a4, b4 := a.IP.To4() != nil, b.IP.To4() != nil; a4 != b4 {
+			return a4
+		}
+		if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+			return c < 0
+		}
+		return a.Zone < b.Zone
+	})
+}
+
+// parseIPZone parses an IP literal, which may be an IPv6 one with a zone
+// like "fe80::1%eth0".
+func parseIPZone(s string) (net.IPAddr, bool) {
+	zone := ""
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+		if zone == "" || strings.IndexByte(s, ':') < 0 {
+			return net.IPAddr{}, false
+		}
+	}
+	ip := net.ParseIP(s)
+	return net.IPAddr{IP: ip, Zone: zone}, ip != nil
+}
+
+// EntriesNearingExpiry returns the cached hosts whose entries expire
+// within the given window, for callers that drive refreshes themselves.
+func (d *Dialer) EntriesNearingExpiry(within time.Duration) []string {
+	now := time.Now()
+
+	d.addrs.rlockAll()
+	var hosts []string
+	d.addrs.each(func(host string, e *hostEntry) bool {
+		if e.resolved.Add(d.ttl(e)).Sub(now) <= within {
+			hosts = append(hosts, host)
+		}
+		return true
+	})
+	d.addrs.runlockAll()
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Healthy reports whether at least one cached host still has an address
+// that hasn't been evicted.
+func (d *Dialer) Healthy() bool {
+	d.addrs.rlockAll()
+	defer d.addrs.runlockAll()
+
+	if d.addrs.len() == 0 {
+		return d.HealthyWhenEmpty
+	}
+	healthy := false
+	now := time.Now()
+	d.addrs.each(func(_ string, e *hostEntry) bool {
+		healthy = d.usable(e, now)
+		return !healthy
+	})
+	return healthy
+}
+
+// HostHealthy reports whether host has at least one usable cached address.
+func (d *Dialer) HostHealthy(host string) bool {
+	s := d.addrs.shard(host)
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	e, ok := s.get(host)
+	if !ok {
+		return d.HealthyWhenEmpty
+	}
+	return d.usable(e, time.Now())
+}
+
+// AddrsFor returns a copy of the addresses currently cached for host, keyed
+// as in Snapshot. It's empty if there are none.
+func (d *Dialer) AddrsFor(host string) []string {
+	s := d.addrs.shard(host)
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	e, ok := s.get(host)
+	if !ok {
+		return []string{}
+	}
+	return append([]string{}, e.addrs...)
+}
+
+// withPort returns address with DefaultPort added if it has no port.
+// Addresses that are malformed otherwise are left for the lookup to
+// reject.
+func (d *Dialer) withPort(address string) (string, error) {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address, nil
+	}
+	if d.SRV && isSRVName(address) {
+		return address, nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if _, _, err := net.SplitHostPort(net.JoinHostPort(host, "0")); err != nil {
+		return address, nil
+	}
+	if d.DefaultPort == "" {
+		return "", &dialError{ErrMissingPort, errors.New(`address "` + address + `"`)}
+	}
+	return net.JoinHostPort(host, d.DefaultPort), nil
+}
+
+// remoteResolver is a dialer that can be handed host names to resolve
+// itself, like a SOCKS5Proxy with RemoteResolve.
+type remoteResolver interface {
+	resolvesRemotely() bool
+}
+
+// dialRemote dials host through D without resolving or caching it.
+func (d *Dialer) dialRemote(ctx context.Context, network, host string) (net.Conn, string, error) {
+	if d.BlockPrivateIPs || len(d.DenyCIDRs) > 0 || d.Filter != nil ||
+		d.ExcludeSpecialUse || d.ExcludeIPv4 || d.ExcludeIPv6 {
+		return nil, "", errRemoteFiltered
+	}
+	conn, err := d.timedDial(ctx, network, host)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, host, nil
+}
+
+// dialLiteral dials an address whose host is an IP, if the filters allow
+// it, without caching anything.
+func (d *Dialer) dialLiteral(ctx context.Context, network, key string) (net.Conn, string, error) {
+	addrs, err := d.resolve(ctx, key)
+	if err == nil && len(addrs) == 0 {
+		_, _, address := splitCacheKey(key)
+		err = errors.New(`address "` + address + `" is excluded`)
+	}
+	if err != nil {
+		return nil, "", &dialError{ErrResolutionFailed, err}
+	}
+
+	conn, err := d.timedDial(ctx, network, addrs[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, addrs[0], nil
+}
+
+// isIPLiteral reports whether the host of address is an IP.
+func isIPLiteral(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	// don't bother parsing what can't be an IP
+	if strings.IndexByte(host, ':') < 0 && (host[0] < '0' || host[0] > '9') {
+		return false
+	}
+	_, ok := parseIPZone(host)
+	return ok
+}
+
+// pick chooses the address to dial out of the non-empty addrs cached in e
+// under key for host.
+func (d *Dialer) pick(e *hostEntry, key, host string, addrs []string) string {
+	if prio, _ := e.prio.Load().(map[string]uint16); prio != nil {
+		addrs = addrs[:topPriority(prio, addrs)]
+	}
+
+	if d.Affinity {
+		if addr, _ := e.lastGood.Load().(string); addr != "" && contains(addrs, addr) {
+			return addr
+		}
+	}
+
+	if d.Strategy != nil {
+		i := d.Strategy.Pick(host, addrs)
+		if i < 0 || i >= len(addrs) {
+			i = 0
+		}
+		return addrs[i]
+	}
+
+	idx := atomic.AddInt64(&e.idx, 1)
+	if d.RampUpNewAddrs && d.RampUpWindow > 0 && d.RampUpWeight > 1 {
+		if addr, ok := d.pickRampUp(key, addrs, idx); ok {
+			return addr
+		}
+	}
+	return addrs[int(idx)%len(addrs)]
+}
+
+// topPriority returns how many of the leading addrs, which are sorted by
+// priority, share the best one.
+func topPriority(prio map[string]uint16, addrs []string) int {
+	n := 1
+	for n < len(addrs) && prio[addrs[n]] == prio[addrs[0]] {
+		n++
+	}
+	return n
+}
+
+// pickRampUp does a weighted round-robin over addrs while at least one of
+// them is still ramping up. It reports false when all weights are equal.
+func (d *Dialer) pickRampUp(host string, addrs []string, idx int64) (string, bool) {
+	now := time.Now()
+
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+
+	seen := d.firstSeen[host]
+	var total int64
+	for _, a := range addrs {
+		total += d.rampUpWeight(seen[a], now)
+	}
+	if total == int64(len(addrs))*rampUpScale {
+		return "", false
+	}
+
+	pos := idx % total
+	for _, a := range addrs {
+		pos -= d.rampUpWeight(seen[a], now)
+		if pos < 0 {
+			return a, true
+		}
+	}
+	return addrs[len(addrs)-1], true
+}
+
+func (d *Dialer) rampUpWeight(firstSeen, now time.Time) int64 {
+	age := now.Sub(firstSeen)
+	if firstSeen.IsZero() || age >= d.RampUpWindow {
+		return rampUpScale
+	}
+	extra := int64(d.RampUpWeight-1) * rampUpScale * int64(d.RampUpWindow-age) / int64(d.RampUpWindow)
+	return rampUpScale + extra
+}
+
+// trackNewAddrs remembers when each address of host was first seen.
+// Addresses from the very first resolution aren't considered new.
+func (d *Dialer) trackNewAddrs(host string, addrs []string) {
+	if d.firstSeen == nil {
+		d.firstSeen = map[string]map[string]time.Time{}
+	}
+
+	prev, known := d.firstSeen[host]
+	now := time.Now()
+	seen := make(map[string]time.Time, len(addrs))
+	for _, a := range addrs {
+		if t, ok := prev[a]; ok {
+			seen[a] = t
+		} else if known {
+			seen[a] = now
+		} else {
+			seen[a] = time.Time{}
+		}
+	}
+	d.firstSeen[host] = seen
+}
+
+// getAddrs returns the entry cached for address along with a snapshot of
+// its addresses, resolving it first if needed. The entry is nil when
+// there's nothing cached.
+func (d *Dialer) getAddrs(ctx context.Context, address string) (*hostEntry, []string, error) {
+	now := time.Now()
+
+	var addrs []string
+	expired, cooled := false, false
+
+	s := d.addrs.shard(address)
+	s.mx.RLock()
+	e, ok := s.get(address)
+	if ok {
+		addrs = e.addrs
+		expired = now.Sub(e.resolved) > d.ttl(e)
+		cooled = e.cooledDown(now)
+	}
+	s.mx.RUnlock()
+
+	if cooled {
+		s.mx.Lock()
+		if e, ok = s.get(address); ok {
+			addrs = e.requeue(now)
+		}
+		s.mx.Unlock()
+		if ok {
+			d.noteHealth(address, len(addrs) > 0)
+		}
+	}
+
+	if expired && d.StaleWhileRevalidate && len(addrs) > 0 {
+		if atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+			go d.refresh(address, e)
+		}
+		d.noteCache(ctx, address, true)
+		return e, addrs, nil
+	}
+
+	if expired || len(addrs) == 0 {
+		forced := ok && !expired // every cached IP was evicted
+
+		addrs, ev, err := d.updateAddrs(ctx, address)
+		s.mx.RLock()
+		e, _ = s.get(address)
+		s.mx.RUnlock()
+
+		d.noteCache(ctx, address, false)
+		d.noteResolve(ev)
+		if forced && ev.done {
+			atomic.AddInt64(&d.forcedResolves, 1)
+			if d.OnForcedResolve != nil {
+				d.OnForcedResolve(address)
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		d.noteHealth(address, len(addrs) > 0)
+		return e, addrs, nil
+	}
+
+	d.noteCache(ctx, address, true)
+	return e, addrs, nil
+}
+
+func (d *Dialer) noteCache(ctx context.Context, host string, hit bool) {
+	d.setAttribute(ctx, "cdialer.cache_hit", hit)
+	if hit {
+		atomic.AddInt64(&d.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&d.cacheMisses, 1)
+	}
+	if hit && d.OnCacheHit != nil {
+		d.OnCacheHit(host)
+	} else if !hit && d.OnCacheMiss != nil {
+		d.OnCacheMiss(host)
+	}
+}
+
+// resolveEvent describes a lookup for OnResolve. It's reported once the
+// lock is released.
+type resolveEvent struct {
+	host  string
+	addrs int
+	took  time.Duration
+	err   error
+	done  bool // false when no lookup was made
+
+	negative time.Duration // how long the failure got cached for
+}
+
+func (d *Dialer) noteResolve(ev resolveEvent) {
+	if !ev.done {
+		return
+	}
+	atomic.AddInt64(&d.resolves, 1)
+	if d.OnResolve != nil {
+		d.OnResolve(ev.host, ev.addrs, ev.took, ev.err)
+	}
+	switch {
+	case ev.err == nil:
+		d.logf("cdialer: resolved %s to %d addresses in %v", ev.host, ev.addrs, ev.took)
+	case ev.negative > 0:
+		d.logf("cdialer: resolving %s failed, not retrying for %v: %v", ev.host, ev.negative, ev.err)
+	default:
+		d.logf("cdialer: resolving %s failed: %v", ev.host, ev.err)
+	}
+}
+
+func (d *Dialer) logf(format string, v ...interface{}) {
+	if d.Logger != nil {
+		d.Logger.Printf(format, v...)
+	}
+}
+
+// refresh re-resolves the stale entry e cached under address.
+func (d *Dialer) refresh(address string, e *hostEntry) {
+	defer atomic.StoreInt32(&e.refreshing, 0)
+
+	addrs, ev, err := d.updateAddrs(context.Background(), address)
+	d.noteResolve(ev)
+	if err == nil {
+		d.noteHealth(address, len(addrs) > 0)
+	}
+}
+
+// noteHealth records the current health of host and reports it through
+// OnHostHealthChange if it differs from the last reported state.
+func (d *Dialer) noteHealth(host string, healthy bool) {
+	if d.OnHostHealthChange == nil {
+		return
+	}
+	if d.HealthDebounce <= 0 {
+		d.reportHealth(host, healthy)
+		return
+	}
+
+	d.healthMx.Lock()
+	defer d.healthMx.Unlock()
+
+	if d.healthTimers == nil {
+		d.healthTimers = map[string]*time.Timer{}
+	}
+	if _, ok := d.healthTimers[host]; ok {
+		return
+	}
+	d.healthTimers[host] = time.AfterFunc(d.HealthDebounce, func() {
+		d.healthMx.Lock()
+		delete(d.healthTimers, host)
+		d.healthMx.Unlock()
+
+		s := d.addrs.shard(host)
+		s.mx.RLock()
+		e, ok := s.get(host)
+		healthy := ok && len(e.addrs) > 0
+		s.mx.RUnlock()
+		if ok {
+			d.reportHealth(host, healthy)
+		}
+	})
+}
+
+func (d *Dialer) reportHealth(host string, healthy bool) {
+	d.healthMx.Lock()
+	changed := d.reportedDown[host] == healthy
+	if changed {
+		if d.reportedDown == nil {
+			d.reportedDown = map[string]bool{}
+		}
+		if healthy {
+			delete(d.reportedDown, host)
+		} else {
+			d.reportedDown[host] = true
+		}
+	}
+	d.healthMx.Unlock()
+
+	if changed {
+		d.OnHostHealthChange(host, healthy)
+	}
+}
+
+// updateAddrs resolves address and caches the result, unless another
+// goroutine made its entry fresh meanwhile or MinResolveInterval or
+// NegativeTTL hold the lookup back. Concurrent calls for the same address
+// share a single lookup, which only the caller that made it gets an event
+// for. It must be called without d.mx held.
+func (d *Dialer) updateAddrs(ctx context.Context, address string) ([]string, resolveEvent, error) {
+	var ev resolveEvent
+	addrs, err, shared := d.flights.do(ctx, address, func() ([]string, error) {
+		var addrs []string
+		var err error
+		addrs, ev, err = d.lookupAddrs(ctx, address)
+		return addrs, err
+	})
+	if shared && err != nil && isContextErr(err) && ctx.Err() == nil {
+		// the context of the caller that made the lookup was done,
+		// which says nothing about ours
+		return d.lookupAddrs(ctx, address)
+	}
+	return addrs, ev, err
+}
+
+func (d *Dialer) lookupAddrs(ctx context.Context, address string) ([]string, resolveEvent, error) {
+	now := time.Now()
+	s := d.addrs.shard(address)
+
+	s.mx.Lock()
+	e, ok := s.get(address)
+	if ok && len(e.addrs) > 0 && now.Sub(e.resolved) <= d.ttl(e) {
+		addrs := e.addrs
+		s.mx.Unlock()
+		return addrs, resolveEvent{}, nil
+	}
+	s.mx.Unlock()
+
+	if r, ok := d.stored(address); ok {
+		s.mx.Lock()
+		addrs := d.storeAddrs(s, address, r)
+		s.mx.Unlock()
+		return addrs, resolveEvent{}, nil
+	}
+	if r, found := d.cachedHostIPs(address, now); found && !ok {
+		r = d.precheck(ctx, r)
+		s.mx.Lock()
+		addrs, expires := d.storeAddrs(s, address, r), d.expiry(s, address)
+		s.mx.Unlock()
+
+		d.share(address, r, expires)
+		return addrs, resolveEvent{}, nil
+	}
+
+	s.mx.Lock()
+	e, ok = s.get(address)
+	if d.MinResolveInterval > 0 {
+		d.mx.RLock()
+		last, throttled := d.lastResolve[address]
+		d.mx.RUnlock()
+		if throttled && now.Sub(last.at) < d.MinResolveInterval {
+			var addrs []string
+			if ok {
+				addrs = e.addrs
+			}
+			s.mx.Unlock()
+			return addrs, resolveEvent{}, last.err
+		}
+	}
+	if ok && d.NegativeTTL > 0 && now.Sub(e.failed) < d.NegativeTTL {
+		err := e.failErr
+		s.mx.Unlock()
+		return nil, resolveEvent{}, err
+	}
+	var stale []string
+	if ok {
+		stale = e.addrs
+	}
+	s.mx.Unlock()
+
+	if allowed, err := d.allowLookup(ctx, len(stale) > 0); !allowed {
+		return stale, resolveEvent{}, err
+	}
+
+	start := time.Now()
+	r, err := d.tracedLookup(ctx, address)
+	ev := resolveEvent{host: address, addrs: len(r.addrs), took: time.Since(start), err: err, done: true}
+	if err != nil && ctx.Err() != nil {
+		return nil, ev, err // the dial gave up, which says nothing about the host
+	}
+	if err == nil {
+		r = d.precheck(ctx, r)
+	}
+
+	s.mx.Lock()
+	if d.MinResolveInterval > 0 {
+		d.mx.Lock()
+		if d.lastResolve == nil {
+			d.lastResolve = map[string]resolveResult{}
+		}
+		d.lastResolve[address] = resolveResult{at: time.Now(), err: err}
+		d.mx.Unlock()
+	}
+	if err != nil {
+		if d.NegativeTTL > 0 {
+			e, ok := s.get(address)
+			if !ok {
+				e = &hostEntry{}
+				s.put(address, e)
+			}
+			e.failed = time.Now()
+			e.failErr = err
+			ev.negative = d.NegativeTTL
+		}
+		s.mx.Unlock()
+		return nil, ev, err
+	}
+
+	addrs, expires := d.storeAddrs(s, address, r), d.expiry(s, address)
+	s.mx.Unlock()
+
+	d.share(address, r, expires)
+	return addrs, ev, nil
+}
+
+// expiry returns when the entry cached under key expires. s is the shard
+// of key and must be locked.
+func (d *Dialer) expiry(s *cacheShard, key string) time.Time {
+	e, _ := s.get(key)
+	return e.resolved.Add(d.ttl(e))
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// storeAddrs caches what a lookup of address found and returns the
+// addresses that ended up in the entry. s is the shard of address and must
+// be locked.
+func (d *Dialer) storeAddrs(s *cacheShard, address string, r lookupResult) []string {
+	addrs := r.addrs
+	if d.InternAddrs {
+		for i := range addrs {
+			addrs[i] = d.interned.intern(addrs[i])
+		}
+	}
+
+	e, ok := s.get(address)
+	if !ok {
+		e = &hostEntry{}
+		s.put(address, e)
+	}
+	e.failed = time.Time{}
+	e.failErr = nil
+	if d.PreserveAddrOrder {
+		addrs = mergeAddrs(e.addrs, addrs)
+	}
+	if r.prio != nil {
+		sort.SliceStable(addrs, func(i, j int) bool { return r.prio[addrs[i]] < r.prio[addrs[j]] })
+	}
+	if r.prio != nil || e.prio.Load() != nil {
+		e.prio.Store(r.prio)
+	}
+	now := time.Now()
+	e.addrs = e.withoutCooling(addrs, now)
+	e.resolved = now
+	e.ttl = r.ttl
+	e.jitter = d.newJitter()
+
+	d.mx.Lock()
+	d.trackChanges(address, addrs)
+	if d.RampUpNewAddrs {
+		d.trackNewAddrs(address, addrs)
+	}
+	if r.ips != nil {
+		if d.hostIPs == nil {
+			d.hostIPs = map[string]hostIPs{}
+		}
+		d.hostIPs[hostIPsKey(address)] = hostIPs{ips: r.ips, ttl: r.ttl, resolved: now}
+	}
+	d.mx.Unlock()
+
+	return e.addrs
+}
+
+// initDialer makes the Dialer dial through a *net.Dialer if it wasn't
+// given one.
+func (d *Dialer) initDialer() {
+	d.mx.RLock()
+	ok := d.D != nil
+	d.mx.RUnlock()
+	if ok {
+		return
+	}
+
+	d.mx.Lock()
+	if d.D == nil {
+		d.D = &net.Dialer{Timeout: d.ConnectTimeout, KeepAlive: d.KeepAlive}
+	}
+	d.mx.Unlock()
+}
+
+func (d *Dialer) trackChanges(host string, addrs []string) {
+	var hash uint64
+	for _, a := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(a))
+		hash += h.Sum64()
+	}
+
+	if d.addrSets == nil {
+		d.addrSets = map[string]addrSet{}
+	}
+	set, ok := d.addrSets[host]
+	if ok && set.hash != hash {
+		set.changes++
+		atomic.AddInt64(&d.addrSetChanges, 1)
+	}
+	set.hash = hash
+	d.addrSets[host] = set
+}
+
+// mergeAddrs returns next ordered so that addresses already in prev come
+// first, in prev's order, followed by the ones that are new.
+func mergeAddrs(prev, next []string) []string {
+	present := make(map[string]bool, len(next))
+	for _, a := range next {
+		present[a] = true
+	}
+
+	merged := make([]string, 0, len(next))
+	survived := make(map[string]bool, len(prev))
+	for _, a := range prev {
+		if present[a] && !survived[a] {
+			merged = append(merged, a)
+			survived[a] = true
+		}
+	}
+	for _, a := range next {
+		if !survived[a] {
+			merged = append(merged, a)
+		}
+	}
+	return merged
+}
+
+func (d *Dialer) resolve(ctx context.Context, key string) ([]string, error) {
+	r, err := d.lookup(ctx, key)
+	return r.addrs, err
+}
+
+// lookupResult is what a successful lookup found.
+type lookupResult struct {
+	addrs []string
+	ttl   time.Duration     // lowest record TTL, zero when the resolver didn't tell
+	prio  map[string]uint16 // SRV priority of each address, nil for other hosts
+	ips   []net.IPAddr      // what the host name was looked up to, if it was
+}
+
+// tracedLookup is lookup in a span of its own.
+func (d *Dialer) tracedLookup(ctx context.Context, key string) (r lookupResult, err error) {
+	if d.Tracer != nil {
+		var span Span
+		ctx, span = d.startSpan(ctx, "cdialer.resolve")
+		span.SetAttribute("cdialer.host", key)
+		defer endSpan(span, &err)
+		defer func() { span.SetAttribute("cdialer.addrs", len(r.addrs)) }() // before endSpan
+	}
+	return d.lookup(ctx, key)
+}
+
+// lookup is like resolve but also returns the lowest TTL of the records,
+// if the Resolver is a TTLResolver, and the priorities of SRV targets.
+func (d *Dialer) lookup(ctx context.Context, key string) (lookupResult, error) {
+	wantIPv4, wantIPv6, address := splitCacheKey(key)
+	if d.SRV && isSRVName(address) {
+		if d.ExcludeIPv4 && d.ExcludeIPv6 {
+			return lookupResult{}, errExcludesBothFamilies
+		}
+		return d.lookupSRV(ctx, address, d.newAddrFilter(wantIPv4, wantIPv6))
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return lookupResult{}, err
+	}
+
+	if d.ExcludeIPv4 && d.ExcludeIPv6 {
+		return lookupResult{}, errExcludesBothFamilies
+	}
+
+	var ipAddrs []net.IPAddr
+	var ttl time.Duration
+	ipAddr, literal := parseIPZone(host)
+	if literal {
+		ipAddrs = []net.IPAddr{ipAddr}
+	} else if ipAddrs, ttl, err = d.lookupIPAddr(ctx, d.resolver(), host); err != nil {
+		return lookupResult{}, err
+	}
+	r, err := d.portAddrs(wantIPv4, wantIPv6, host, port, ipAddrs, ttl)
+	if err == nil && !literal {
+		r.ips = ipAddrs
+	}
+	return r, err
+}
+
+// portAddrs filters the addresses host was looked up to and makes them
+// the addresses to dial on port.
+func (d *Dialer) portAddrs(wantIPv4, wantIPv6 bool, host, port string, ipAddrs []net.IPAddr, ttl time.Duration) (lookupResult, error) {
+	f := d.newAddrFilter(wantIPv4, wantIPv6)
+	addrs := d.capAddrs(f.addrs(ipAddrs, port))
+	if err := f.err(host, addrs); err != nil {
+		return lookupResult{}, err
+	}
+	return lookupResult{addrs: addrs, ttl: ttl}, nil
+}
+
+// hostIPsKey is key without its port.
+func hostIPsKey(key string) string {
+	if i := strings.LastIndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// cachedHostIPs returns the addresses for key from a lookup of its host
+// name made for another port, if it's still fresh. Its TTL is what's left
+// of that lookup's.
+func (d *Dialer) cachedHostIPs(key string, now time.Time) (lookupResult, bool) {
+	wantIPv4, wantIPv6, address := splitCacheKey(key)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || d.SRV && isSRVName(address) {
+		return lookupResult{}, false
+	}
+
+	d.mx.RLock()
+	h, ok := d.hostIPs[hostIPsKey(key)]
+	ttl := h.ttl
+	if ttl <= 0 {
+		ttl = d.TTL
+	}
+	d.mx.RUnlock()
+	left := h.resolved.Add(ttl).Sub(now)
+	if !ok || left <= 0 {
+		return lookupResult{}, false
+	}
+
+	r, err := d.portAddrs(wantIPv4, wantIPv6, host, port, h.ips, left)
+	return r, err == nil
+}
+
+// forgetHostIPs drops the host name lookup of key. d.mx must be held.
+func (d *Dialer) forgetHostIPs(key string) {
+	delete(d.hostIPs, hostIPsKey(key))
+}
+
+func (d *Dialer) resolver() Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	if d.LookupIP != nil {
+		return LookupIPFunc(d.LookupIP)
+	}
+	return net.DefaultResolver
+}
+
+func (d *Dialer) lookupIPAddr(ctx context.Context, r Resolver, host string) ([]net.IPAddr, time.Duration, error) {
+	if cr, ok := r.(CNAMEResolver); ok && d.MaxCNAMEDepth > 0 {
+		target, err := d.followCNAMEs(ctx, cr, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		host = target
+	}
+	if tr, ok := r.(TTLResolver); ok {
+		return tr.LookupIPAddrTTL(ctx, host)
+	}
+	ipAddrs, err := r.LookupIPAddr(ctx, host)
+	return ipAddrs, 0, err
+}
+
+// followCNAMEs returns the name the CNAME chain starting at host ends at.
+func (d *Dialer) followCNAMEs(ctx context.Context, r CNAMEResolver, host string) (string, error) {
+	name := host
+	seen := map[string]bool{canonicalName(host): true}
+	for depth := 0; ; depth++ {
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		c := canonicalName(cname)
+		if c == "" || c == canonicalName(name) {
+			return name, nil
+		}
+		if seen[c] {
+			return "", &dialError{ErrCNAMEChain, errors.New(`"` + host + `" loops at "` + cname + `"`)}
+		}
+		if depth == d.MaxCNAMEDepth {
+			return "", &dialError{ErrCNAMEChain, errors.New(`"` + host + `" has more than ` + strconv.Itoa(d.MaxCNAMEDepth) + ` CNAMEs`)}
+		}
+		seen[c] = true
+		name = strings.TrimSuffix(cname, ".")
+	}
+}
+
+// sortSRV orders srvs by priority, and those of equal priority at random
+// by weight, as RFC 2782 has it.
+func sortSRV(srvs []*net.SRV) {
+	sort.SliceStable(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j])
+		i = j
+	}
+}
+
+// shuffleByWeight orders srvs picking each next one with a chance in
+// proportion to its weight. Zero weights come last, in their order.
+func shuffleByWeight(srvs []*net.SRV) {
+	for ; len(srvs) > 1; srvs = srvs[1:] {
+		sum := 0
+		for _, srv := range srvs {
+			sum += int(srv.Weight)
+		}
+		if sum == 0 {
+			return
+		}
+		n, acc := rand.Intn(sum), 0
+		for i, srv := range srvs {
+			if acc += int(srv.Weight); acc > n {
+				copy(srvs[1:i+1], srvs[:i])
+				srvs[0] = srv
+				break
+			}
+		}
+	}
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupSRV resolves the SRV records of name and the addresses of their
+// targets, in priority order.
+func (d *Dialer) lookupSRV(ctx context.Context, name string, f *addrFilter) (lookupResult, error) {
+	r := d.resolver()
+	sr, ok := r.(SRVResolver)
+	if !ok {
+		sr = net.DefaultResolver
+	}
+	_, srvs, err := sr.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return lookupResult{}, err
+	}
+	sortSRV(srvs)
+
+	res := lookupResult{prio: map[string]uint16{}}
+	var errs []error
+	for _, srv := range srvs {
+		ipAddrs, ttl, err := d.lookupIPAddr(ctx, r, strings.TrimSuffix(srv.Target, "."))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ttl > 0 && (res.ttl == 0 || ttl < res.ttl) {
+			res.ttl = ttl
+		}
+		for _, addr := range f.addrs(ipAddrs, strconv.Itoa(int(srv.Port))) {
+			res.addrs = append(res.addrs, addr)
+			res.prio[addr] = srv.Priority
+		}
+	}
+	res.addrs = d.capAddrs(res.addrs)
+
+	if len(res.addrs) == 0 && len(errs) > 0 {
+		return lookupResult{}, errors.Join(errs...)
+	}
+	if err := f.err(name, res.addrs); err != nil {
+		return lookupResult{}, err
+	}
+	return res, nil
+}
+
+// isSRVName reports whether host is named like "_service._proto.name".
+func isSRVName(host string) bool {
+	labels := strings.SplitN(host, ".", 3)
+	return len(labels) == 3 && strings.HasPrefix(labels[0], "_") &&
+		strings.HasPrefix(labels[1], "_") && !strings.Contains(labels[2], ":")
+}
+
+func (d *Dialer) capAddrs(addrs []string) []string {
+	if d.MaxAddrs > 0 && len(addrs) > d.MaxAddrs {
+		return addrs[:d.MaxAddrs:d.MaxAddrs]
+	}
+	return addrs
+}
+
+// addrFilter turns looked up IPs into the addresses to cache, leaving out
+// the excluded families, blocked and special-use IPs and duplicates.
+type addrFilter struct {
+	d                        *Dialer
+	excludeIPv4, excludeIPv6 bool
+	special, blocked         int
+	seen                     map[string]bool
+}
+
+func (d *Dialer) newAddrFilter(wantIPv4, wantIPv6 bool) *addrFilter {
+	f := &addrFilter{
+		d:           d,
+		excludeIPv4: !wantIPv4 || d.ExcludeIPv4,
+		excludeIPv6: !wantIPv6 || d.ExcludeIPv6,
+		seen:        map[string]bool{},
+	}
+	if d.AutoDetectFamily {
+		v4, v6 := d.detectFamilies()
+		if v4 && !v6 {
+			f.excludeIPv6 = true
+		} else if v6 && !v4 {
+			f.excludeIPv4 = true
+		}
+	}
+	return f
+}
+
+// addrs returns the addresses of ipAddrs on port that pass the filter.
+func (f *addrFilter) addrs(ipAddrs []net.IPAddr, port string) []string {
+	d := f.d
+	addrs := make([]string, 0, len(ipAddrs))
+	var ipv6Addrs []string
+	for _, ipAddr := range ipAddrs {
+		ip := ipAddr.IP
+
+		// IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are IPv4 for our
+		// purposes and get dialed in dotted-quad form.
+		isIPv4 := ip.To4() != nil
+		if isIPv4 {
+			ip = ip.To4()
+		}
+
+		if !isIPv4 && f.excludeIPv6 || isIPv4 && f.excludeIPv4 {
+			continue
+		}
+
+		if d.isBlocked(ip) {
+			f.blocked++
+			continue
+		}
+
+		if d.ExcludeSpecialUse && isSpecialUse(ip) {
+			f.special++
+			continue
+		}
+
+		host := ip.String()
+		if ipAddr.Zone != "" && !isIPv4 {
+			host += "%" + ipAddr.Zone // link-local addresses need it to be dialed
+		}
+		addr := "[" + host + "]:" + port
+		if f.seen[addr] {
+			continue // duplicate records would skew the rotation
+		}
+		f.seen[addr] = true
+
+		if !isIPv4 && d.PreferIPv6 {
+			ipv6Addrs = append(ipv6Addrs, addr)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	switch {
+	case d.SortAddrs:
+		sortAddrs(ipv6Addrs)
+		sortAddrs(addrs)
+	case d.ShuffleOnResolve:
+		shuffle(ipv6Addrs)
+		shuffle(addrs)
+	}
+	if len(ipv6Addrs) > 0 {
+		addrs = append(ipv6Addrs, addrs...)
+	}
+	return addrs
+}
+
+// err explains why the lookup of host left no addrs to cache, if it was
+// down to the filter.
+func (f *addrFilter) err(host string, addrs []string) error {
+	if len(addrs) == 0 && f.blocked > 0 && f.special == 0 {
+		return &dialError{ErrAddrsBlocked, errors.New(`host "` + host + `"`)}
+	}
+	if len(addrs) == 0 && f.special > 0 {
+		return errors.New(`dialer: "` + host + `" resolves only to special-use addresses`)
+	}
+	return nil
+}
+
+func shuffle(addrs []string) {
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+}
+
+func (d *Dialer) isBlocked(ip net.IP) bool {
+	if d.BlockPrivateIPs && (ip.IsPrivate() || ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()) {
+		return true
+	}
+	for _, n := range d.DenyCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return d.Filter != nil && !d.Filter(ip)
+}
+
+func isSpecialUse(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast()
+}
+
+func (d *Dialer) detectFamilies() (v4, v6 bool) {
+	d.familyMx.Lock()
+	defer d.familyMx.Unlock()
+
+	now := time.Now()
+	if d.familyChecked.IsZero() ||
+		d.FamilyCheckInterval > 0 && now.Sub(d.familyChecked) > d.FamilyCheckInterval {
+		probe := d.ProbeFamily
+		if probe == nil {
+			probe = probeFamily
+		}
+		d.hasIPv4 = probe("udp4")
+		d.hasIPv6 = probe("udp6")
+		d.familyChecked = now
+	}
+	return d.hasIPv4, d.hasIPv6
+}
+
+// probeFamily reports whether there's a route for the given network. UDP
+// "connect" doesn't send any packets, so the probe is cheap.
+func probeFamily(network string) bool {
+	addr := probeIPv4Addr
+	if network == "udp6" {
+		addr = probeIPv6Addr
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
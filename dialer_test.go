@@ -1,8 +1,17 @@
 package cdialer
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +26,39 @@ func (d testDialer) Dial(network, address string) (net.Conn, error) {
 	return d.d(network, address)
 }
 
+// withEntries caches entries in d and returns d.
+func withEntries(d *Dialer, entries map[string]*hostEntry) *Dialer {
+	for key, e := range entries {
+		s := d.addrs.shard(key)
+		s.mx.Lock()
+		s.put(key, e)
+		s.mx.Unlock()
+	}
+	return d
+}
+
+// entry returns the entry d caches under key, or nil.
+func entry(d *Dialer, key string) *hostEntry {
+	s := d.addrs.shard(key)
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	e, _ := s.get(key)
+	return e
+}
+
+// entries returns every entry d caches.
+func entries(d *Dialer) map[string]*hostEntry {
+	d.addrs.rlockAll()
+	defer d.addrs.runlockAll()
+
+	m := map[string]*hostEntry{}
+	d.addrs.each(func(key string, e *hostEntry) bool {
+		m[key] = e
+		return true
+	})
+	return m
+}
+
 func TestNoPanic(t *testing.T) {
 	d := &Dialer{}
 	d.Dial("tcp", "localhost")
@@ -25,6 +67,44 @@ func TestNoPanic(t *testing.T) {
 	d.Dial("tcp", "localhost:80")
 }
 
+func TestDefaultPort(t *testing.T) {
+	var used string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			used = address
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	_, err := d.Dial("tcp", "localhost")
+	assert.ErrorIs(t, err, ErrMissingPort)
+	assert.ErrorContains(t, err, `"localhost"`)
+	_, err = d.Dial("tcp", "2001:db8::1")
+	assert.ErrorIs(t, err, ErrMissingPort)
+	assert.Empty(t, used)
+
+	d.DefaultPort = "8080"
+	testCases := []struct {
+		address string
+		used    string
+	}{
+		{address: "localhost", used: "[10.0.0.1]:8080"},
+		{address: "localhost:80", used: "[10.0.0.1]:80"},
+		{address: "2001:db8::1", used: "[2001:db8::1]:8080"},
+		{address: "[2001:db8::1]", used: "[2001:db8::1]:8080"},
+	}
+	for _, tc := range testCases {
+		_, err := d.Dial("tcp", tc.address)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.used, used)
+	}
+	assert.Contains(t, entries(d), "localhost:8080")
+}
+
 func TestWrap(t *testing.T) {
 	used := false
 	dial := testDialer{d: func(string, string) (net.Conn, error) {
@@ -41,17 +121,15 @@ func TestReuseIP(t *testing.T) {
 	usedIPs := make([]string, 0)
 
 	c := &net.TCPConn{}
-	d := &Dialer{
+	d := withEntries(&Dialer{
 		D: testDialer{d: func(network string, address string) (net.Conn, error) {
 			usedIPs = append(usedIPs, address)
 			return c, nil
 		}},
-		TTL:      defaultTTL,
-		resolved: time.Now(),
-		addrs: map[string][]string{
-			"github.com:80": []string{"10.0.0.1:80"},
-		},
-	}
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
 
 	testCases := []string{"10.0.0.1:80", "10.0.0.1:80", "10.0.0.1:80"}
 	for i, v := range testCases {
@@ -66,17 +144,15 @@ func TestIterateOverCachedIPs(t *testing.T) {
 	usedIPs := make([]string, 0)
 
 	c := &net.TCPConn{}
-	d := &Dialer{
+	d := withEntries(&Dialer{
 		D: testDialer{d: func(network string, address string) (net.Conn, error) {
 			usedIPs = append(usedIPs, address)
 			return c, nil
 		}},
-		TTL:      defaultTTL,
-		resolved: time.Now(),
-		addrs: map[string][]string{
-			"github.com:80": []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
-		},
-	}
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
 
 	testCases := []string{
 		"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80",
@@ -95,20 +171,22 @@ func TestRemoveBrokenIPFromCache(t *testing.T) {
 	usedIPs := make([]string, 0)
 
 	e := errors.New("Invalid address")
-	d := &Dialer{
+	d := withEntries(&Dialer{
 		D: testDialer{d: func(network string, address string) (net.Conn, error) {
 			usedIPs = append(usedIPs, address)
 			return nil, e
 		}},
-		TTL:      defaultTTL,
-		resolved: time.Now(),
-		addrs: map[string][]string{
-			"github.com:80": []string{
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
+	}, map[string]*hostEntry{
+		"github.com:80": {
+			addrs: []string{
 				"10.0.0.1:80", "10.0.0.2:80",
 				"10.0.0.3:80", "10.0.0.4:80",
 			},
+			resolved: time.Now(),
 		},
-	}
+	})
 
 	testCases := []struct {
 		used string
@@ -134,10 +212,267 @@ func TestRemoveBrokenIPFromCache(t *testing.T) {
 
 	for i := range testCases {
 		_, err := d.Dial("tcp", "github.com:80")
-		assert.Equal(t, err, e)
+		assert.ErrorIs(t, err, e)
+		assert.Equal(t, len(testCases[i].left) == 0, errors.Is(err, ErrAllAddrsUnreachable))
 		assert.Equal(t, testCases[i].used, usedIPs[i])
-		assert.Equal(t, d.addrs["github.com:80"], testCases[i].left)
+		assert.Equal(t, entry(d, "github.com:80").addrs, testCases[i].left)
+	}
+}
+
+func TestDialTriesEveryCachedIP(t *testing.T) {
+	var usedIPs []string
+	down := map[string]bool{"10.0.0.2:80": true, "10.0.0.3:80": true}
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			if down[address] {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"}, usedIPs)
+	assert.Equal(t, []string{"10.0.0.1:80"}, entry(d, "github.com:80").addrs)
+
+	down["10.0.0.1:80"] = true
+	entry(d, "github.com:80").addrs = []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	usedIPs = nil
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	assert.ErrorContains(t, err, "10.0.0.1:80: connection refused")
+	assert.ErrorContains(t, err, "10.0.0.3:80: connection refused")
+	assert.Len(t, usedIPs, 3)
+
+	d.MaxAttempts = 2
+	entry(d, "github.com:80").addrs = []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	usedIPs = nil
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrAllAddrsUnreachable))
+	assert.Len(t, usedIPs, 2)
+	assert.Len(t, entry(d, "github.com:80").addrs, 1)
+}
+
+func TestDialTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	var usedIPs []string
+	d := withEntries(&Dialer{
+		D: testContextDialer{dc: func(ctx context.Context, network, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			if address == "10.0.0.2:80" {
+				<-ctx.Done() // black-holed
+				return nil, ctx.Err()
+			}
+			return client, nil
+		}},
+		TTL:         defaultTTL,
+		Strategy:    FirstHealthy{},
+		DialTimeout: 20 * time.Millisecond,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.2:80", "10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	start := time.Now()
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, client, conn)
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.1:80"}, usedIPs)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// the parent's earlier deadline still wins
+	d.DialTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	usedIPs = nil
+	_, err = d.DialContext(ctx, "tcp", "github.com:80")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []string{"10.0.0.2:80"}, usedIPs)
+}
+
+func TestDialDeadlineBoundsAttempts(t *testing.T) {
+	var usedIPs []string
+	d := withEntries(&Dialer{
+		D: testContextDialer{dc: func(ctx context.Context, network, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(80 * time.Millisecond):
+				return nil, errors.New("connection refused")
+			}
+		}},
+		TTL:      defaultTTL,
+		Strategy: FirstHealthy{},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	took := time.Since(start)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "connection refused") // from the first attempt
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, usedIPs)
+	assert.True(t, took >= 100*time.Millisecond && took < 200*time.Millisecond, took)
+
+	// a longer deadline is split between the attempts left
+	ctx, cancel = context.WithTimeout(context.Background(), 9*time.Second)
+	defer cancel()
+	attemptCtx, cancelAttempt := attemptContext(ctx, 3)
+	deadline, _ := attemptCtx.Deadline()
+	assert.True(t, time.Until(deadline) > 2900*time.Millisecond && time.Until(deadline) <= 3*time.Second)
+	cancelAttempt()
+	attemptCtx, cancelAttempt = attemptContext(ctx, 6) // but not below 2s
+	defer cancelAttempt()
+	deadline, _ = attemptCtx.Deadline()
+	assert.True(t, time.Until(deadline) > 1900*time.Millisecond && time.Until(deadline) <= 2*time.Second)
+	attemptCtx, _ = attemptContext(ctx, 1)
+	assert.Equal(t, ctx, attemptCtx)
+}
+
+func TestLocalAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+	d := withEntries(&Dialer{
+		D:         &net.Dialer{},
+		TTL:       defaultTTL,
+		LocalAddr: local,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{l.Addr().String()}, resolved: time.Now()},
+	})
+
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+	assert.Nil(t, d.D.(*net.Dialer).LocalAddr)
+
+	// dialers other than *net.Dialer can't be told, and dial as usual
+	var used string
+	d.D = testDialer{d: func(network string, address string) (net.Conn, error) {
+		used = address
+		return nil, nil
+	}}
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, l.Addr().String(), used)
+}
+
+func TestDefaultDialerSettings(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	d := &Dialer{
+		TTL:            defaultTTL,
+		ConnectTimeout: 5 * time.Second,
+		KeepAlive:      time.Minute,
 	}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, &net.Dialer{Timeout: 5 * time.Second, KeepAlive: time.Minute}, d.D)
+
+	// settings made after NewDialer count too
+	n := NewDialer(func(d *Dialer) { d.ConnectTimeout = time.Second })
+	n.KeepAlive = time.Minute
+	conn, err = n.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, &net.Dialer{Timeout: time.Second, KeepAlive: time.Minute}, n.D)
+
+	// a dialer of one's own is left alone
+	custom := &net.Dialer{}
+	n = NewDialer(WithDialer(custom), func(d *Dialer) { d.ConnectTimeout = time.Second })
+	assert.Same(t, custom, n.D)
+	assert.Zero(t, custom.Timeout)
+}
+
+func TestDialErrorJoinsFailures(t *testing.T) {
+	errTimeout := errors.New("i/o timeout")
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			switch address {
+			case "10.0.0.1:80":
+				return nil, errTimeout
+			case "10.0.0.2:80":
+				panic("boom")
+			}
+			return nil, errors.New("connection refused")
+		}},
+		TTL:               defaultTTL,
+		RecoverDialPanics: true,
+		EvictOnErrorMatch: ErrorContains("connection refused"),
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, errTimeout)
+	assert.ErrorIs(t, err, ErrDialPanic)
+	assert.False(t, errors.Is(err, ErrAllAddrsUnreachable))
+
+	var dialErr *DialError
+	assert.True(t, errors.As(err, &dialErr))
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"}, dialErr.Addrs)
+	assert.Len(t, dialErr.Errs, 3)
+	assert.Contains(t, err.Error(), "10.0.0.3:80: connection refused")
+}
+
+func TestReresolveOnEmpty(t *testing.T) {
+	lookups := 0
+	var forced []string
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "[10.0.0.3]:80" {
+				return nil, nil
+			}
+			return nil, errors.New("connection refused")
+		}},
+		TTL:              defaultTTL,
+		ReresolveOnEmpty: true,
+		OnForcedResolve: func(host string) {
+			forced = append(forced, host)
+		},
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.3")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, []string{"github.com:80"}, forced)
+	assert.Equal(t, []string{"[10.0.0.3]:80"}, entry(d, "github.com:80").addrs)
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lookups)
 }
 
 func TestResolveHostWhenCacheIsEmpty(t *testing.T) {
@@ -151,8 +486,8 @@ func TestResolveHostWhenCacheIsEmpty(t *testing.T) {
 			usedIPs = append(usedIPs, address)
 			return nil, e
 		}},
-		TTL:      defaultTTL,
-		resolved: time.Now(),
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
 		LookupIP: func(string) ([]net.IP, error) {
 			resolved <- true
 
@@ -205,9 +540,9 @@ func TestResolveHostWhenCacheIsEmpty(t *testing.T) {
 
 	for i := range testCases {
 		_, err := d.Dial("tcp", "github.com:80")
-		assert.Equal(t, err, e)
+		assert.ErrorIs(t, err, e)
 		assert.Equal(t, testCases[i].used, usedIPs[i])
-		assert.Equal(t, d.addrs["github.com:80"], testCases[i].left)
+		assert.Equal(t, entry(d, "github.com:80").addrs, testCases[i].left)
 
 		var resolving bool
 		select {
@@ -221,12 +556,8 @@ func TestResolveHostWhenCacheIsEmpty(t *testing.T) {
 func TestResolveNewIPsWhenTTLExpired(t *testing.T) {
 	var usedIP string
 
-	d := &Dialer{
-		TTL:      defaultTTL,
-		resolved: time.Now().Add(-defaultTTL),
-		addrs: map[string][]string{
-			"github.com:80": []string{"10.0.0.1:80"},
-		},
+	d := withEntries(&Dialer{
+		TTL: defaultTTL,
 		D: testDialer{d: func(network string, address string) (net.Conn, error) {
 			usedIP = address
 			return nil, nil
@@ -234,12 +565,14 @@ func TestResolveNewIPsWhenTTLExpired(t *testing.T) {
 		LookupIP: func(host string) ([]net.IP, error) {
 			return []net.IP{net.ParseIP("10.0.0.2")}, nil
 		},
-	}
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-defaultTTL)},
+	})
 
 	_, err := d.Dial("tcp", "github.com:80")
 	assert.Nil(t, err)
 	assert.Equal(t, usedIP, "[10.0.0.2]:80")
-	assert.Equal(t, d.addrs["github.com:80"], []string{"[10.0.0.2]:80"})
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"[10.0.0.2]:80"})
 }
 
 func TestResolve(t *testing.T) {
@@ -254,7 +587,7 @@ func TestResolve(t *testing.T) {
 		},
 	}
 
-	addrs, err := d.resolve("github.com:80")
+	addrs, err := d.resolve(context.Background(), "github.com:80")
 	assert.NoError(t, err)
 	assert.Len(t, addrs, 3)
 	assert.Equal(t, addrs[0], "[10.11.12.13]:80")
@@ -275,9 +608,2376 @@ func TestResolveExcludesIPv6(t *testing.T) {
 		},
 	}
 
-	addrs, err := d.resolve("github.com:80")
+	addrs, err := d.resolve(context.Background(), "github.com:80")
 	assert.NoError(t, err)
 	assert.Len(t, addrs, 2)
 	assert.Equal(t, addrs[0], "[10.11.12.13]:80")
 	assert.Equal(t, addrs[1], "[10.11.12.14]:80")
 }
+
+func TestResolveExcludesIPv4(t *testing.T) {
+	d := Dialer{
+		ExcludeIPv4: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			ips := []net.IP{
+				net.ParseIP("10.11.12.13"),
+				net.ParseIP("2001:470:1:18::119"),
+				net.ParseIP("2001:470:1:18::120"),
+			}
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+	assert.Equal(t, addrs[0], "[2001:470:1:18::119]:80")
+	assert.Equal(t, addrs[1], "[2001:470:1:18::120]:80")
+
+	d.ExcludeIPv6 = true
+	_, err = d.resolve(context.Background(), "github.com:80")
+	assert.Error(t, err)
+}
+
+func TestResolvePrefersIPv6(t *testing.T) {
+	d := Dialer{
+		PreferIPv6: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			ips := []net.IP{
+				net.ParseIP("10.11.12.13"),
+				net.ParseIP("2001:470:1:18::119"),
+				net.ParseIP("10.11.12.14"),
+				net.ParseIP("2001:470:1:18::120"),
+			}
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"[2001:470:1:18::119]:80",
+		"[2001:470:1:18::120]:80",
+		"[10.11.12.13]:80",
+		"[10.11.12.14]:80",
+	}, addrs)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var usedIPs []string
+	var lookups int32
+	release := make(chan struct{})
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			return nil, nil
+		}},
+		TTL:                  time.Minute,
+		StaleWhileRevalidate: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			<-release
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-time.Hour)},
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.1:80", "10.0.0.1:80"}, usedIPs)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		_, err := d.Dial("tcp", "github.com:80")
+		return err == nil && usedIPs[len(usedIPs)-1] == "[10.0.0.2]:80"
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+}
+
+func TestMetricsHooks(t *testing.T) {
+	var events []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "[10.0.0.2]:80" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+	// the hooks taking the cache lock shows they're called without it
+	d.OnCacheHit = func(host string) {
+		d.Snapshot()
+		events = append(events, "hit "+host)
+	}
+	d.OnCacheMiss = func(host string) {
+		d.Snapshot()
+		events = append(events, "miss "+host)
+	}
+	d.OnResolve = func(host string, addrs int, took time.Duration, err error) {
+		d.Snapshot()
+		events = append(events, "resolve "+host+" "+strconv.Itoa(addrs))
+	}
+	d.OnDial = func(addr string, took time.Duration, err error) {
+		d.Snapshot()
+		events = append(events, "dial "+addr+" "+strconv.FormatBool(err == nil))
+	}
+
+	d.Dial("tcp", "github.com:80")
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, []string{
+		"miss github.com:80",
+		"resolve github.com:80 2",
+		"dial [10.0.0.2]:80 false",
+		"dial [10.0.0.1]:80 true",
+		"hit github.com:80",
+		"dial [10.0.0.1]:80 true",
+	}, events)
+}
+
+type testLogger []string
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	var logged testLogger
+	failLookup := false
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		}},
+		TTL:         defaultTTL,
+		NegativeTTL: time.Minute,
+		MaxAttempts: 1,
+		Logger:      &logged,
+		LookupIP: func(host string) ([]net.IP, error) {
+			if failLookup {
+				return nil, errors.New("no such host")
+			}
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	d.Dial("tcp", "github.com:80")
+	failLookup = true
+	d.Dial("tcp", "github.com:80")
+	d.Dial("tcp", "github.com:80")
+
+	assert.Len(t, logged, 3)
+	assert.Contains(t, logged[0], "resolved github.com:80 to 1 addresses")
+	assert.Equal(t, "cdialer: removed [10.0.0.1]:80 for host github.com:80: connection refused", logged[1])
+	assert.Equal(t, "cdialer: resolving github.com:80 failed, not retrying for 1m0s: no such host", logged[2])
+}
+
+func TestInvalidateOnNetworkChange(t *testing.T) {
+	lookups := 0
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+		"gitlab.com:80": {addrs: []string{"10.0.1.1:80"}, resolved: time.Now()},
+	})
+
+	d.InvalidateOnNetworkChange()
+	assert.Empty(t, entries(d))
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	_, err = d.Dial("tcp", "gitlab.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lookups)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"[10.0.0.2]:80"})
+	assert.Equal(t, entry(d, "gitlab.com:80").addrs, []string{"[10.0.0.2]:80"})
+}
+
+func TestSnapshot(t *testing.T) {
+	resolved := time.Now().Add(-time.Minute)
+	d := withEntries(&Dialer{
+		TTL: time.Hour,
+	}, map[string]*hostEntry{
+		"github.com:80":     {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: resolved},
+		"ip4/gitlab.com:80": {addrs: []string{"10.0.1.1:80"}, resolved: resolved.Add(-2 * time.Hour)},
+	})
+
+	snap := d.Snapshot()
+	assert.Len(t, snap, 2)
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, snap["github.com:80"].Addrs)
+	assert.Equal(t, resolved, snap["github.com:80"].Resolved)
+	assert.InDelta(t, float64(59*time.Minute), float64(snap["github.com:80"].TTL), float64(time.Second))
+	assert.Equal(t, time.Duration(0), snap["ip4/gitlab.com:80"].TTL)
+
+	snap["github.com:80"].Addrs[0] = "10.0.0.9:80"
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, entry(d, "github.com:80").addrs)
+}
+
+func TestAddrsFor(t *testing.T) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "[10.0.0.1]:80" {
+				return nil, errors.New("refused")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+	assert.Equal(t, []string{}, d.AddrsFor("github.com:80"))
+
+	assert.Nil(t, d.Warm(context.Background(), "github.com:80"))
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.2]:80"}, d.AddrsFor("github.com:80"))
+
+	// round-robin reaches the failing address on one of them
+	for i := 0; i < 2; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+	}
+	addrs := d.AddrsFor("github.com:80")
+	assert.Equal(t, []string{"[10.0.0.2]:80"}, addrs)
+
+	addrs[0] = "[10.0.0.9]:80"
+	assert.Equal(t, []string{"[10.0.0.2]:80"}, d.AddrsFor("github.com:80"))
+}
+
+func TestFlushAndEvict(t *testing.T) {
+	var wg sync.WaitGroup
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Dial("tcp", "github.com:80")
+			d.Dial("tcp4", "github.com:80")
+			d.Dial("tcp", "gitlab.com:80")
+			d.Evict("gitlab.com:80")
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, d.Evict("github.com:80"))
+	assert.False(t, d.Evict("github.com:80"))
+	assert.NotContains(t, entries(d), "github.com:80")
+	assert.NotContains(t, entries(d), "ip4/github.com:80")
+
+	d.Dial("tcp", "github.com:80")
+	d.Flush()
+	assert.Empty(t, entries(d))
+	assert.False(t, d.Evict("github.com:80"))
+}
+
+func TestResolveAutoDetectFamily(t *testing.T) {
+	reachable := map[string]bool{"udp4": true, "udp6": false}
+	probes := 0
+	d := Dialer{
+		AutoDetectFamily:    true,
+		FamilyCheckInterval: time.Minute,
+		ProbeFamily: func(network string) bool {
+			probes++
+			return reachable[network]
+		},
+		LookupIP: func(host string) ([]net.IP, error) {
+			ips := []net.IP{
+				net.ParseIP("10.11.12.13"),
+				net.ParseIP("2001:470:1:18::119"),
+			}
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[10.11.12.13]:80"})
+	assert.Equal(t, 2, probes)
+
+	// within the interval the previous result is reused
+	reachable = map[string]bool{"udp4": false, "udp6": true}
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[10.11.12.13]:80"})
+	assert.Equal(t, 2, probes)
+
+	d.familyChecked = time.Now().Add(-2 * time.Minute)
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[2001:470:1:18::119]:80"})
+	assert.Equal(t, 4, probes)
+
+	// both or neither family reachable keeps everything
+	reachable = map[string]bool{"udp4": true, "udp6": true}
+	d.familyChecked = time.Time{}
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+}
+
+func TestDialErrorSentinels(t *testing.T) {
+	lookupErr := errors.New("no such host")
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			t.Fatal("dial must not be attempted")
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return nil, lookupErr
+		},
+	}
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	assert.ErrorIs(t, err, lookupErr)
+	assert.False(t, errors.Is(err, ErrAllAddrsUnreachable))
+
+	d.LookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{}, nil
+	}
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+
+	refused := errors.New("connection refused")
+	d = withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, refused
+		}},
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Equal(t, err, refused)
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	assert.ErrorIs(t, err, refused)
+	assert.False(t, errors.Is(err, ErrResolutionFailed))
+}
+
+func TestRampUpNewAddrs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}
+	used := map[string]int{}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			used[address]++
+			return nil, nil
+		}},
+		TTL:            defaultTTL,
+		RampUpNewAddrs: true,
+		RampUpWindow:   time.Hour,
+		RampUpWeight:   3,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+
+	// the backend scales up
+	ips = append(ips, net.ParseIP("10.0.0.3"))
+	entry(d, "github.com:80").resolved = time.Now().Add(-2 * defaultTTL)
+	used = map[string]int{}
+	for i := 0; i < 500; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+	}
+	assert.Len(t, entry(d, "github.com:80").addrs, 3)
+	assert.True(t, used["[10.0.0.3]:80"] > 2*used["[10.0.0.1]:80"]-5, used)
+	assert.True(t, used["[10.0.0.3]:80"] > 2*used["[10.0.0.2]:80"]-5, used)
+
+	// once the window is over all addresses get an equal share
+	d.firstSeen["github.com:80"]["[10.0.0.3]:80"] = time.Now().Add(-time.Hour)
+	used = map[string]int{}
+	for i := 0; i < 300; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, map[string]int{
+		"[10.0.0.1]:80": 100,
+		"[10.0.0.2]:80": 100,
+		"[10.0.0.3]:80": 100,
+	}, used)
+}
+
+func warmDialer() *Dialer {
+	c := &net.TCPConn{}
+	return withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return c, nil
+		}},
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+}
+
+func TestDialCacheHitDoesNotAllocate(t *testing.T) {
+	d := warmDialer()
+	allocs := testing.AllocsPerRun(1000, func() {
+		d.Dial("tcp", "github.com:80")
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestDialDefaultDialerConcurrently(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// D is only set by the first dials
+	d := &Dialer{
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := d.Dial("tcp", "github.com:"+port)
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkDialCacheHit(b *testing.B) {
+	d := warmDialer()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+}
+
+// BenchmarkDialManyHosts dials 1000 cached hosts in parallel, with the
+// cache behind a single lock as it used to be and sharded.
+func BenchmarkDialManyHosts(b *testing.B) {
+	b.Run("single lock", func(b *testing.B) { benchmarkDialManyHosts(b, 1) })
+	b.Run("sharded", func(b *testing.B) { benchmarkDialManyHosts(b, cacheShards) })
+}
+
+func benchmarkDialManyHosts(b *testing.B, shards int) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+	}
+	d.addrs.shards = make([]cacheShard, shards)
+
+	hosts := make([]string, 1000)
+	cached := make(map[string]*hostEntry, len(hosts))
+	for i := range hosts {
+		hosts[i] = "host" + strconv.Itoa(i) + ".example.com:80"
+		cached[hosts[i]] = &hostEntry{addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()}
+	}
+	withEntries(d, cached)
+
+	var seed int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddInt64(&seed, 1) * 7919
+		for pb.Next() {
+			i++
+			d.Dial("tcp", hosts[i%int64(len(hosts))])
+		}
+	})
+}
+
+func TestResolveIPv4MappedIsIPv4(t *testing.T) {
+	d := Dialer{
+		ExcludeIPv6: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			ips := []net.IP{
+				net.ParseIP("::ffff:10.11.12.13"),
+				net.ParseIP("2001:470:1:18::119"),
+			}
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[10.11.12.13]:80"})
+
+	d.ExcludeIPv6 = false
+	d.AutoDetectFamily = true
+	d.ProbeFamily = func(network string) bool { return network == "udp6" }
+
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[2001:470:1:18::119]:80"})
+}
+
+func TestForcedResolveOnEmptyPool(t *testing.T) {
+	var forced []string
+	lookups := 0
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, errors.New("Invalid address")
+		}},
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.3")}, nil
+		},
+		OnForcedResolve: func(host string) {
+			forced = append(forced, host)
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	// a cold host is a regular miss, not a forced resolve
+	d.Dial("tcp", "gitlab.com:80")
+	assert.Equal(t, 1, lookups)
+	assert.Empty(t, forced)
+	assert.Equal(t, int64(0), d.Stats().ForcedResolves)
+
+	d.Dial("tcp", "github.com:80")
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{})
+	assert.Equal(t, 1, lookups)
+
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, 2, lookups)
+	assert.Equal(t, []string{"github.com:80"}, forced)
+	assert.Equal(t, int64(1), d.Stats().ForcedResolves)
+}
+
+func TestStats(t *testing.T) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "[10.0.0.1]:80" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL:      defaultTTL,
+		Strategy: FirstHealthy{},
+		LookupIP: func(host string) ([]net.IP, error) {
+			if host == "bad.example.com" {
+				return nil, errors.New("no such host")
+			}
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+
+	d.Dial("tcp", "github.com:80") // evicts 10.0.0.1 and connects to 10.0.0.2
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Dial("tcp", "github.com:80")
+		}()
+	}
+	wg.Wait()
+	d.Dial("tcp", "bad.example.com:80")
+	d.Dial("tcp", "github.com")
+
+	assert.Equal(t, Stats{
+		Resolves:      2,
+		CacheHits:     10,
+		CacheMisses:   2,
+		DialSuccesses: 11,
+		DialFailures:  2,
+		Evictions:     1,
+	}, d.Stats())
+}
+
+func TestHealthy(t *testing.T) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, errors.New("Invalid address")
+		}},
+		TTL: defaultTTL,
+	}
+
+	assert.False(t, d.Healthy())
+	assert.False(t, d.HostHealthy("github.com:80"))
+	d.HealthyWhenEmpty = true
+	assert.True(t, d.Healthy())
+	assert.True(t, d.HostHealthy("github.com:80"))
+
+	withEntries(d, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+		"gitlab.com:80": {addrs: []string{"10.0.1.1:80"}, resolved: time.Now()},
+	})
+	assert.True(t, d.Healthy())
+	assert.True(t, d.HostHealthy("github.com:80"))
+
+	// degraded: one host lost all of its addresses
+	d.Dial("tcp", "github.com:80")
+	assert.True(t, d.Healthy())
+	assert.False(t, d.HostHealthy("github.com:80"))
+	assert.True(t, d.HostHealthy("gitlab.com:80"))
+
+	d.Dial("tcp", "gitlab.com:80")
+	assert.False(t, d.Healthy())
+	assert.False(t, d.HostHealthy("gitlab.com:80"))
+}
+
+func TestPreserveAddrOrderOnReresolve(t *testing.T) {
+	d := withEntries(&Dialer{
+		TTL:               defaultTTL,
+		PreserveAddrOrder: true,
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		LookupIP: func(host string) ([]net.IP, error) {
+			ips := []net.IP{
+				net.ParseIP("10.0.0.1"),
+				net.ParseIP("10.0.0.4"),
+				net.ParseIP("10.0.0.3"),
+			}
+			return ips, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"[10.0.0.3]:80", "[10.0.0.1]:80", "[10.0.0.2]:80"}, resolved: time.Now().Add(-2 * defaultTTL)},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{
+		"[10.0.0.3]:80", "[10.0.0.1]:80", "[10.0.0.4]:80",
+	})
+
+	d.PreserveAddrOrder = false
+	entry(d, "github.com:80").resolved = time.Now().Add(-2 * defaultTTL)
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{
+		"[10.0.0.1]:80", "[10.0.0.4]:80", "[10.0.0.3]:80",
+	})
+}
+
+func TestValidateDoesNotTouchCache(t *testing.T) {
+	resolved := time.Now()
+	d := withEntries(&Dialer{
+		TTL:         defaultTTL,
+		ExcludeIPv6: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			if host == "ipv6.github.com" {
+				return []net.IP{net.ParseIP("2001:470:1:18::119")}, nil
+			}
+			return []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("2001:470:1:18::119")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: resolved},
+	})
+
+	addrs, err := d.Validate(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[10.0.0.2]:80"})
+
+	_, err = d.Validate(context.Background(), "ipv6.github.com:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+
+	_, err = d.Validate(context.Background(), "github.com")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.Validate(ctx, "github.com:80")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	assert.Equal(t, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: resolved},
+	}, entries(d))
+}
+
+type healthEdge struct {
+	host    string
+	healthy bool
+}
+
+type healthRecorder struct {
+	mx    sync.Mutex
+	edges []healthEdge
+}
+
+func (r *healthRecorder) record(host string, healthy bool) {
+	r.mx.Lock()
+	r.edges = append(r.edges, healthEdge{host, healthy})
+	r.mx.Unlock()
+}
+
+func (r *healthRecorder) get() []healthEdge {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]healthEdge{}, r.edges...)
+}
+
+func TestOnHostHealthChange(t *testing.T) {
+	fail := true
+	rec := &healthRecorder{}
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if fail {
+				return nil, errors.New("Invalid address")
+			}
+			return nil, nil
+		}},
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.3")}, nil
+		},
+		OnHostHealthChange: rec.record,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	d.Dial("tcp", "github.com:80")
+	assert.Empty(t, rec.get())
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, []healthEdge{{"github.com:80", false}}, rec.get())
+
+	fail = false
+	for i := 0; i < 3; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []healthEdge{
+		{"github.com:80", false},
+		{"github.com:80", true},
+	}, rec.get())
+}
+
+func TestOnHostHealthChangeDebounce(t *testing.T) {
+	fail := true
+	rec := &healthRecorder{}
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if fail {
+				return nil, errors.New("Invalid address")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.3")}, nil
+		},
+		OnHostHealthChange: rec.record,
+		HealthDebounce:     50 * time.Millisecond,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	// down and straight back up is a flap and isn't reported
+	d.Dial("tcp", "github.com:80")
+	fail = false
+	d.Dial("tcp", "github.com:80")
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, rec.get())
+
+	fail = true
+	d.Dial("tcp", "github.com:80")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, []healthEdge{{"github.com:80", false}}, rec.get())
+}
+
+func benchmarkSharedIPs(b *testing.B, intern bool) {
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"),
+		net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4"),
+	}
+	hosts := make([]string, 1000)
+	for i := range hosts {
+		hosts[i] = "host" + strconv.Itoa(i) + ".cdn.com:80"
+	}
+
+	var retained uint64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		d := &Dialer{
+			TTL:         defaultTTL,
+			InternAddrs: intern,
+			LookupIP: func(host string) ([]net.IP, error) {
+				return ips, nil
+			},
+		}
+		for _, h := range hosts {
+			d.updateAddrs(context.Background(), h)
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(d)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+}
+
+func BenchmarkSharedIPs(b *testing.B) {
+	b.Run("plain", func(b *testing.B) { benchmarkSharedIPs(b, false) })
+	b.Run("interned", func(b *testing.B) { benchmarkSharedIPs(b, true) })
+}
+
+func TestNetworkRewrite(t *testing.T) {
+	var usedNetwork string
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedNetwork = network
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		NetworkRewrite: func(network string) string {
+			if network == "tcp" {
+				return "tcp4"
+			}
+			return network
+		},
+	}, map[string]*hostEntry{
+		"ip4/github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+		"github.com:80":     {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp4", usedNetwork)
+
+	_, err = d.Dial("udp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, "udp", usedNetwork)
+}
+
+func TestNetworkRewriteFamily(t *testing.T) {
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, network+" "+address)
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		NetworkRewrite: func(network string) string {
+			return network + "4"
+		},
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	// only the addresses the rewritten network can reach are cached
+	for i := 0; i < 2; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"tcp4 [10.0.0.1]:80", "tcp4 [10.0.0.1]:80"}, dialed)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(d, "ip4/github.com:80").addrs)
+}
+
+func TestDialersShareNoState(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+	}
+	dial := testDialer{d: func(network string, address string) (net.Conn, error) {
+		return nil, errors.New("Invalid address")
+	}}
+
+	a := Wrap(dial)
+	a.LookupIP = lookup
+	a.MaxAttempts = 1
+	b := Wrap(dial)
+	b.LookupIP = lookup
+	b.MaxAttempts = 1
+
+	a.TTL = time.Minute
+	a.Dial("tcp", "github.com:80")
+
+	assert.Equal(t, DefaultTTL(), b.TTL)
+	assert.Empty(t, entries(b))
+
+	b.Dial("tcp", "github.com:80")
+	assert.Equal(t, entry(a, "github.com:80").addrs, entry(b, "github.com:80").addrs)
+	assert.Len(t, entry(a, "github.com:80").addrs, 1)
+}
+
+func TestEvictOnErrorMatch(t *testing.T) {
+	var dialErr error
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, dialErr
+		}},
+		TTL:               defaultTTL,
+		MaxAttempts:       1,
+		EvictOnErrorMatch: ErrorContains("connection refused", "no route to host"),
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	dialErr = errors.New("dial: i/o timeout")
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Equal(t, dialErr, err)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"10.0.0.1:80", "10.0.0.2:80"})
+
+	dialErr = errors.New("dial: connection refused")
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Equal(t, dialErr, err)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"10.0.0.2:80"})
+}
+
+func TestTransientErrorsDontEvict(t *testing.T) {
+	var dialErr error
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, dialErr
+		}},
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80"}, resolved: time.Now()},
+	})
+
+	for _, dialErr = range []error{
+		context.Canceled,
+		context.DeadlineExceeded,
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded},
+	} {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.ErrorIs(t, err, dialErr)
+		assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, entry(d, "github.com:80").addrs)
+	}
+
+	// the caller giving up mid-dial
+	ctx, cancel := context.WithCancel(context.Background())
+	d.D = testContextDialer{dc: func(ctx context.Context, network, address string) (net.Conn, error) {
+		cancel()
+		return nil, ctx.Err()
+	}}
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, entry(d, "github.com:80").addrs)
+
+	d.D = testDialer{d: func(network string, address string) (net.Conn, error) {
+		return nil, dialErr
+	}}
+	d.ShouldEvict = func(err error) bool {
+		return errors.Is(err, context.Canceled)
+	}
+	dialErr = errors.New("connection refused")
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, entry(d, "github.com:80").addrs)
+
+	dialErr = context.Canceled
+	d.MaxAttempts = 1
+	d.Dial("tcp", "github.com:80")
+	assert.Len(t, entry(d, "github.com:80").addrs, 1)
+}
+
+func TestEvictCooldown(t *testing.T) {
+	var usedIPs []string
+	down := map[string]bool{"10.0.0.2:80": true}
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			if down[address] {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL:           defaultTTL,
+		EvictCooldown: time.Minute,
+		Strategy:      FirstHealthy{},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.2:80", "10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.1:80"}, usedIPs)
+	assert.Equal(t, []string{"10.0.0.1:80"}, entry(d, "github.com:80").addrs)
+
+	// still cooling down
+	down["10.0.0.2:80"] = false
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, []string{"10.0.0.1:80"}, entry(d, "github.com:80").addrs)
+
+	entry(d, "github.com:80").cooling[0].until = time.Now().Add(-time.Second)
+	d.Dial("tcp", "github.com:80")
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, entry(d, "github.com:80").addrs)
+	assert.Empty(t, entry(d, "github.com:80").cooling)
+}
+
+func TestEvictCooldownSurvivesReresolve(t *testing.T) {
+	d := withEntries(&Dialer{
+		TTL:           defaultTTL,
+		EvictCooldown: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {
+			cooling: []cooldown{
+				{addr: "[10.0.0.2]:80", until: time.Now().Add(time.Minute)},
+				{addr: "[10.0.0.3]:80", until: time.Now().Add(time.Minute)},
+			},
+		},
+	})
+
+	assert.NoError(t, d.Refresh("github.com:80"))
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(d, "github.com:80").addrs)
+	assert.Len(t, entry(d, "github.com:80").cooling, 1)
+
+	// everything cooling down beats nothing to dial
+	entry(d, "github.com:80").cooling = append(entry(d, "github.com:80").cooling,
+		cooldown{addr: "[10.0.0.1]:80", until: time.Now().Add(time.Minute)})
+	assert.NoError(t, d.Refresh("github.com:80"))
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.2]:80"}, entry(d, "github.com:80").addrs)
+	assert.Empty(t, entry(d, "github.com:80").cooling)
+}
+
+func TestSetTTLWhileDialing(t *testing.T) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_, err := d.Dial("tcp", "github.com:80")
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		d.SetTTL(time.Duration(i%3) * time.Millisecond)
+	}
+	wg.Wait()
+
+	d.SetTTL(time.Minute)
+	d.mx.RLock()
+	assert.Equal(t, time.Minute, d.TTL)
+	d.mx.RUnlock()
+}
+
+func TestRetryCycle(t *testing.T) {
+	var usedIPs []string
+	c := &net.TCPConn{}
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			if address == "10.0.0.1:80" {
+				return nil, errors.New("Invalid address")
+			}
+			return c, nil
+		}},
+		TTL:         defaultTTL,
+		MaxAttempts: 1,
+		RetryCycle:  true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, c, conn)
+	assert.Equal(t, []string{"10.0.0.1:80", "[10.0.0.2]:80"}, usedIPs)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"[10.0.0.2]:80"})
+
+	d.RetryCycle = false
+	entry(d, "github.com:80").addrs = []string{"10.0.0.1:80"}
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+}
+
+func TestRetryCycleWithMinResolveInterval(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, dialErr
+		}},
+		TTL:                defaultTTL,
+		RetryCycle:         true,
+		MinResolveInterval: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	// the retry is throttled like any re-resolution, and keeps the dial
+	// error
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	assert.ErrorIs(t, err, dialErr)
+	assert.Equal(t, 1, lookups)
+
+	d.lastResolve["github.com:80"] = resolveResult{at: time.Now().Add(-2 * time.Minute)}
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, dialErr)
+	assert.Equal(t, 2, lookups)
+}
+
+func TestResolveExcludesSpecialUse(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("10.11.12.13"),
+		net.ParseIP("169.254.1.1"),
+		net.ParseIP("0.0.0.0"),
+		net.ParseIP("224.0.0.1"),
+		net.ParseIP("::1"),
+		net.ParseIP("fe80::1"),
+		net.ParseIP("ff02::1"),
+		net.ParseIP("2001:470:1:18::119"),
+	}
+	d := Dialer{
+		ExcludeSpecialUse: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, addrs, []string{"[10.11.12.13]:80", "[2001:470:1:18::119]:80"})
+
+	ips = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("fe80::1")}
+	_, err = d.resolve(context.Background(), "github.com:80")
+	assert.Error(t, err)
+
+	d.ExcludeSpecialUse = false
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+}
+
+func TestResolveBlocksPrivateIPs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("169.254.169.254"),
+		net.ParseIP("10.11.12.13"),
+		net.ParseIP("192.168.1.1"),
+		net.ParseIP("::ffff:127.0.0.1"),
+		net.ParseIP("::1"),
+		net.ParseIP("fd00::1"),
+		net.ParseIP("93.184.216.34"),
+		net.ParseIP("2606:2800:220:1::1"),
+	}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:             defaultTTL,
+		BlockPrivateIPs: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[93.184.216.34]:80", "[2606:2800:220:1::1]:80"}, addrs)
+
+	_, deny, _ := net.ParseCIDR("2606:2800::/32")
+	d.DenyCIDRs = []*net.IPNet{deny}
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[93.184.216.34]:80"}, addrs)
+
+	// a host rebound to an internal address can't be dialed
+	ips = []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("169.254.169.254"), net.ParseIP("::1")}
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	assert.ErrorIs(t, err, ErrAddrsBlocked)
+	assert.ErrorContains(t, err, "github.com")
+}
+
+func TestResolveFilter(t *testing.T) {
+	_, rejected, _ := net.ParseCIDR("203.0.113.0/24")
+	d := Dialer{
+		Filter: func(ip net.IP) bool {
+			return !rejected.Contains(ip)
+		},
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("203.0.113.7"), net.ParseIP("198.51.100.7"), net.ParseIP("203.0.113.8")}, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[198.51.100.7]:80"}, addrs)
+
+	d.Filter = func(ip net.IP) bool { return false }
+	_, err = d.resolve(context.Background(), "github.com:80")
+	assert.ErrorIs(t, err, ErrAddrsBlocked)
+}
+
+func TestResolveDeduplicates(t *testing.T) {
+	d := Dialer{
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{
+				net.ParseIP("10.0.0.1"),
+				net.ParseIP("10.0.0.2"),
+				net.ParseIP("10.0.0.1"),
+				net.ParseIP("::ffff:10.0.0.2"),
+			}, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.2]:80"}, addrs)
+}
+
+func TestResolveShuffle(t *testing.T) {
+	var ips []net.IP
+	var sorted []string
+	for i := 1; i <= 10; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i))
+		ips = append(ips, ip)
+		sorted = append(sorted, "["+ip.String()+"]:80")
+	}
+	d := Dialer{
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		addrs, err := d.resolve(context.Background(), "github.com:80")
+		assert.NoError(t, err)
+		assert.Equal(t, sorted, addrs)
+	}
+
+	d.ShuffleOnResolve = true
+	shuffled := false
+	for i := 0; i < 10; i++ {
+		addrs, err := d.resolve(context.Background(), "github.com:80")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, sorted, addrs)
+		shuffled = shuffled || strings.Join(addrs, ",") != strings.Join(sorted, ",")
+	}
+	assert.True(t, shuffled)
+}
+
+func TestResolveMaxAddrs(t *testing.T) {
+	var ips []net.IP
+	for i := 1; i <= 20; i++ {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+	d := Dialer{
+		MaxAddrs: 3,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.2]:80", "[10.0.0.3]:80"}, addrs)
+
+	d.ShuffleOnResolve = true
+	addrs, err = d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 3)
+}
+
+func TestChangeCount(t *testing.T) {
+	answers := [][]net.IP{
+		{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")},
+		{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.1")},
+		{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+	}
+	resIdx := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			res := answers[resIdx]
+			resIdx++
+			return res, nil
+		},
+	}
+
+	expected := []int64{0, 0, 1, 2, 2}
+	for i := range answers {
+		if e := entry(d, "github.com:80"); e != nil {
+			e.resolved = time.Time{}
+		}
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.Nil(t, err)
+		assert.Equal(t, expected[i], d.ChangeCount("github.com:80"))
+	}
+	assert.Equal(t, int64(2), d.Stats().AddrSetChanges)
+	assert.Equal(t, int64(0), d.ChangeCount("gitlab.com:80"))
+}
+
+func TestAddrsMatch(t *testing.T) {
+	d := withEntries(&Dialer{
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"[10.0.0.1]:80", "[10.0.0.2]:80", "[2001:470:1:18::119]:80"}, resolved: time.Now()},
+	})
+
+	testCases := []struct {
+		expected []string
+		ok       bool
+		missing  []string
+		extra    []string
+	}{
+		{
+			expected: []string{"10.0.0.2", "10.0.0.1", "2001:470:1:18::119"},
+			ok:       true,
+		},
+		{
+			expected: []string{"10.0.0.1:80", "[10.0.0.2]:80", "[2001:470:1:18::119]:80"},
+			ok:       true,
+		},
+		{
+			expected: []string{"10.0.0.1", "10.0.0.2", "2001:470:1:18::119", "10.0.0.3"},
+			missing:  []string{"10.0.0.3"},
+		},
+		{
+			expected: []string{"10.0.0.1"},
+			extra:    []string{"[10.0.0.2]:80", "[2001:470:1:18::119]:80"},
+		},
+	}
+
+	for _, tc := range testCases {
+		ok, missing, extra, err := d.AddrsMatch("github.com:80", tc.expected)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.ok, ok)
+		assert.Equal(t, tc.missing, missing)
+		assert.Equal(t, tc.extra, extra)
+	}
+
+	d.LookupIP = func(host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	}
+	_, _, _, err := d.AddrsMatch("gitlab.com:80", []string{"10.0.0.1"})
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+}
+
+func TestDialFiltersFamilyByNetwork(t *testing.T) {
+	var usedIPs []string
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, network+" "+address)
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			ips := []net.IP{
+				net.ParseIP("10.0.0.1"),
+				net.ParseIP("2001:470:1:18::119"),
+				net.ParseIP("10.0.0.2"),
+				net.ParseIP("2001:470:1:18::120"),
+			}
+			return ips, nil
+		},
+	}
+
+	testCases := []struct {
+		network string
+		key     string
+		cached  []string
+	}{
+		{
+			network: "tcp4",
+			key:     "ip4/github.com:80",
+			cached:  []string{"[10.0.0.1]:80", "[10.0.0.2]:80"},
+		},
+		{
+			network: "udp4",
+			key:     "ip4/github.com:80",
+			cached:  []string{"[10.0.0.1]:80", "[10.0.0.2]:80"},
+		},
+		{
+			network: "tcp6",
+			key:     "ip6/github.com:80",
+			cached:  []string{"[2001:470:1:18::119]:80", "[2001:470:1:18::120]:80"},
+		},
+		{
+			network: "tcp",
+			key:     "github.com:80",
+			cached: []string{
+				"[10.0.0.1]:80", "[2001:470:1:18::119]:80",
+				"[10.0.0.2]:80", "[2001:470:1:18::120]:80",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		usedIPs = nil
+		for i := 0; i < 4; i++ {
+			_, err := d.Dial(tc.network, "github.com:80")
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, entry(d, tc.key).addrs, tc.cached)
+		for _, used := range usedIPs {
+			assert.Contains(t, tc.cached, used[len(tc.network)+1:])
+			assert.Equal(t, tc.network+" ", used[:len(tc.network)+1])
+		}
+	}
+	assert.Equal(t, 3, lookups)
+
+	d.ExcludeIPv6 = true
+	_, err := d.Dial("tcp6", "gitlab.com:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+}
+
+func TestEntriesNearingExpiry(t *testing.T) {
+	now := time.Now()
+	d := withEntries(&Dialer{
+		TTL: time.Minute,
+	}, map[string]*hostEntry{
+		"github.com:80":    {addrs: []string{"10.0.0.1:80"}, resolved: now},
+		"gitlab.com:80":    {addrs: []string{"10.0.1.1:80"}, resolved: now.Add(-55 * time.Second)},
+		"bitbucket.com:80": {addrs: []string{"10.0.2.1:80"}, resolved: now.Add(-30 * time.Second)},
+	})
+
+	assert.Empty(t, d.EntriesNearingExpiry(time.Second))
+	assert.Equal(t, []string{"gitlab.com:80"}, d.EntriesNearingExpiry(10*time.Second))
+	assert.Equal(t, []string{"bitbucket.com:80", "gitlab.com:80"}, d.EntriesNearingExpiry(40*time.Second))
+	assert.Equal(t, []string{"bitbucket.com:80", "github.com:80", "gitlab.com:80"}, d.EntriesNearingExpiry(2*time.Minute))
+}
+
+func TestRecoverDialPanics(t *testing.T) {
+	boom := errors.New("boom")
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "10.0.0.2:80" {
+				panic(boom)
+			}
+			panic("something went wrong")
+		}},
+		TTL:               defaultTTL,
+		MaxAttempts:       1,
+		RecoverDialPanics: true,
+		EvictOnErrorMatch: func(err error) bool { return false },
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrDialPanic)
+	assert.ErrorIs(t, err, boom)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"10.0.0.1:80", "10.0.0.3:80"})
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrDialPanic)
+	assert.Contains(t, err.Error(), "something went wrong")
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"10.0.0.3:80"})
+
+	d.RecoverDialPanics = false
+	assert.Panics(t, func() { d.Dial("tcp", "github.com:80") })
+}
+
+func TestMinResolveInterval(t *testing.T) {
+	lookups := 0
+	lookupErr := errors.New("no such host")
+	var failLookup bool
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, errors.New("Invalid address")
+		}},
+		TTL:                defaultTTL,
+		MinResolveInterval: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			if failLookup {
+				return nil, lookupErr
+			}
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	// every dial evicts the only IP and would force a re-resolution
+	for i := 0; i < 10; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{})
+
+	failLookup = true
+	d.lastResolve["github.com:80"] = resolveResult{at: time.Now().Add(-2 * time.Minute)}
+	for i := 0; i < 10; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.ErrorIs(t, err, lookupErr)
+	}
+	assert.Equal(t, 2, lookups)
+}
+
+func TestMinResolveIntervalAfterNetworkChange(t *testing.T) {
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:                defaultTTL,
+		MinResolveInterval: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	// the new network's answer isn't held back by the old one's
+	d.InvalidateOnNetworkChange()
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, lookups)
+}
+
+func TestMaxLookupsPerSecond(t *testing.T) {
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:                 defaultTTL,
+		MaxLookupsPerSecond: 50,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	// a burst of a second's worth, then 50 a second
+	start := time.Now()
+	for i := 0; i < 75; i++ {
+		_, err := d.Dial("tcp", "host"+strconv.Itoa(i)+".example.com:80")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 75, lookups)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+
+	// with the bucket empty, stale entries are served as they are...
+	entry(d, "host0.example.com:80").resolved = time.Now().Add(-2 * defaultTTL)
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "host0.example.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "[10.0.0.1]:80", addr)
+	assert.Equal(t, 75, lookups)
+
+	// ...and the others wait no longer than the dial may
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = d.DialContext(ctx, "tcp", "new.example.com:80")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 75, lookups)
+}
+
+func TestConcurrentResolutionsShareLookup(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	var lookups int32
+	release := make(chan struct{})
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return client, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			<-release
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.Dial("tcp", "github.com:80")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let every dial wait on the lookup
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+}
+
+func TestNegativeTTL(t *testing.T) {
+	lookups := 0
+	lookupErr := errors.New("no such host")
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:         defaultTTL,
+		NegativeTTL: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return nil, lookupErr
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := d.Dial("tcp", "github.com:80")
+		assert.ErrorIs(t, err, ErrResolutionFailed)
+		assert.ErrorIs(t, err, lookupErr)
+	}
+	assert.Equal(t, 1, lookups)
+
+	entry(d, "github.com:80").failed = time.Now().Add(-2 * time.Minute)
+	d.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.1")}, nil
+	}
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, lookups)
+	assert.Nil(t, entry(d, "github.com:80").failErr)
+}
+
+type testContextDialer struct {
+	testDialer
+	dc func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (d testContextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dc(ctx, network, address)
+}
+
+func TestDialContextPassesContext(t *testing.T) {
+	type key struct{}
+	var got interface{}
+	d := withEntries(&Dialer{
+		D: testContextDialer{
+			testDialer: testDialer{d: func(network string, address string) (net.Conn, error) {
+				t.Fatal("Dial must not be used when DialContext is available")
+				return nil, nil
+			}},
+			dc: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				got = ctx.Value(key{})
+				return nil, nil
+			},
+		},
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", got)
+}
+
+type testResolver func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r(ctx, host)
+}
+
+func TestResolverGetsDialContext(t *testing.T) {
+	type key struct{}
+	var got interface{}
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:         defaultTTL,
+		NegativeTTL: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			t.Fatal("LookupIP must not be used when Resolver is set")
+			return nil, nil
+		},
+		Resolver: testResolver(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			got = ctx.Value(key{})
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+		}),
+	}
+
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", got)
+
+	// a lookup cut short by the dial's context isn't cached as a failure
+	d.Flush()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = d.resolve(ctx, "github.com:80")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, _, err = d.updateAddrs(ctx, "github.com:80")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, lookups)
+}
+
+type testTTLResolver struct {
+	testResolver
+	ttl time.Duration
+}
+
+func (r testTTLResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	addrs, err := r.testResolver(ctx, host)
+	return addrs, r.ttl, err
+}
+
+func TestRecordTTL(t *testing.T) {
+	lookups := 0
+	r := testTTLResolver{testResolver: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:    time.Hour,
+		MinTTL: time.Minute,
+		MaxTTL: 10 * time.Minute,
+	}
+
+	testCases := []struct {
+		recordTTL time.Duration
+		ttl       time.Duration
+	}{
+		{recordTTL: 5 * time.Minute, ttl: 5 * time.Minute},
+		{recordTTL: time.Second, ttl: time.Minute},
+		{recordTTL: 24 * time.Hour, ttl: 10 * time.Minute},
+		{recordTTL: 0, ttl: time.Hour},
+	}
+
+	for _, tc := range testCases {
+		r.ttl = tc.recordTTL
+		d.Resolver = r
+		d.Flush()
+
+		d.Dial("tcp", "github.com:80")
+		assert.Equal(t, tc.ttl, d.ttl(entry(d, "github.com:80")))
+
+		// still fresh just before the TTL, re-resolved right after it
+		entry(d, "github.com:80").resolved = time.Now().Add(-tc.ttl + time.Second)
+		d.Dial("tcp", "github.com:80")
+		assert.Equal(t, 1, lookups)
+		entry(d, "github.com:80").resolved = time.Now().Add(-tc.ttl - time.Second)
+		d.Dial("tcp", "github.com:80")
+		assert.Equal(t, 2, lookups)
+		lookups = 0
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:       time.Hour,
+		TTLJitter: 0.1,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+		jitterRand: rand.New(rand.NewSource(1)).Float64,
+	}
+
+	ttls := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		host := "host" + strconv.Itoa(i) + ".example.com:80"
+		d.Dial("tcp", host)
+		ttl := d.ttl(entry(d, host))
+		assert.True(t, ttl >= 54*time.Minute && ttl <= 66*time.Minute, ttl)
+		ttls[ttl] = true
+	}
+	assert.True(t, len(ttls) > 90)
+
+	d.TTLJitter = 0
+	d.Refresh("host0.example.com:80")
+	assert.Equal(t, time.Hour, d.ttl(entry(d, "host0.example.com:80")))
+}
+
+type testSRVResolver struct {
+	testResolver
+	srvs []*net.SRV
+}
+
+func (r testSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if name != "_http._tcp.example.com" {
+		return "", nil, errors.New("no such host")
+	}
+	return name, r.srvs, nil
+}
+
+func TestSRV(t *testing.T) {
+	var usedIPs []string
+	down := map[string]bool{}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			if down[address] {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		SRV: true,
+		Resolver: testSRVResolver{
+			testResolver: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+				switch host {
+				case "a.example.com":
+					return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}}, nil
+				case "b.example.com":
+					return []net.IPAddr{{IP: net.ParseIP("10.0.1.1")}}, nil
+				}
+				return nil, errors.New("no such host")
+			},
+			srvs: []*net.SRV{
+				{Target: "b.example.com.", Port: 8081, Priority: 20, Weight: 1},
+				{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 1},
+			},
+		},
+	}
+
+	// the lower priority target isn't used while the other one is up
+	for i := 0; i < 4; i++ {
+		_, err := d.Dial("tcp", "_http._tcp.example.com")
+		assert.NoError(t, err)
+	}
+	assert.ElementsMatch(t, []string{"[10.0.0.1]:8080", "[10.0.0.2]:8080", "[10.0.0.1]:8080", "[10.0.0.2]:8080"}, usedIPs)
+	assert.Equal(t, []string{"[10.0.0.1]:8080", "[10.0.0.2]:8080", "[10.0.1.1]:8081"}, entry(d, "_http._tcp.example.com").addrs)
+
+	down["[10.0.0.1]:8080"] = true
+	down["[10.0.0.2]:8080"] = true
+	usedIPs = nil
+	_, err := d.Dial("tcp", "_http._tcp.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "[10.0.1.1]:8081", usedIPs[len(usedIPs)-1])
+	assert.Len(t, usedIPs, 3)
+
+	// hosts that merely look alike are resolved as usual
+	_, err = d.Dial("tcp", "_http._tcp.example.org")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	assert.False(t, isSRVName("_http._tcp.example.com:80"))
+	assert.False(t, isSRVName("www.example.com"))
+
+	// weights decide how often each target of a priority comes first
+	d.Resolver = testSRVResolver{
+		testResolver: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP(strings.TrimSuffix(host, ".example.com"))}}, nil
+		},
+		srvs: []*net.SRV{
+			{Target: "10.0.0.1.example.com.", Port: 80, Priority: 10, Weight: 1},
+			{Target: "10.0.0.2.example.com.", Port: 80, Priority: 10, Weight: 3},
+			{Target: "10.0.0.3.example.com.", Port: 80, Priority: 20, Weight: 100},
+		},
+	}
+	first := map[string]int{}
+	for i := 0; i < 400; i++ {
+		addrs, err := d.resolve(context.Background(), "_http._tcp.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "[10.0.0.3]:80", addrs[2])
+		first[addrs[0]]++
+	}
+	assert.InDelta(t, 300, first["[10.0.0.2]:80"], 60)
+}
+
+func TestDialIPLiteral(t *testing.T) {
+	lookups := 0
+	var usedIPs []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return nil, errors.New("no such host")
+		},
+	}
+
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "10.0.0.1:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "[10.0.0.1]:80", addr)
+	_, err = d.Dial("tcp", "[2001:db8::1]:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[2001:db8::1]:80"}, usedIPs)
+	assert.Equal(t, 0, lookups)
+	assert.Empty(t, entries(d))
+
+	// the family and block filters still apply
+	usedIPs = nil
+	_, err = d.Dial("tcp4", "[2001:db8::1]:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	d.ExcludeIPv6 = true
+	_, err = d.Dial("tcp", "[2001:db8::1]:80")
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	d.BlockPrivateIPs = true
+	_, err = d.Dial("tcp", "10.0.0.1:80")
+	assert.ErrorIs(t, err, ErrAddrsBlocked)
+	assert.Empty(t, usedIPs)
+	assert.Equal(t, 0, lookups)
+}
+
+func TestDialContextAddr(t *testing.T) {
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "10.0.0.2:80" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.3:80", addr)
+
+	d.D = testDialer{d: func(network string, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}}
+	_, addr, err = d.DialContextAddr(context.Background(), "tcp", "github.com:80")
+	assert.Error(t, err)
+	assert.Equal(t, "", addr)
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	dialed := false
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = true
+			return nil, nil
+		}},
+		TTL:        defaultTTL,
+		RetryCycle: true,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, dialed)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"10.0.0.1:80"})
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = d.DialContext(ctx, "tcp", "github.com:80")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, dialed)
+}
+
+func TestTTLIsTrackedPerHost(t *testing.T) {
+	var lookups []string
+	d := withEntries(&Dialer{
+		TTL: defaultTTL,
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups = append(lookups, host)
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-2 * defaultTTL)},
+		"gitlab.com:80": {addrs: []string{"10.0.1.1:80"}, resolved: time.Now()},
+	})
+
+	// a freshly resolved host doesn't keep another one's stale IPs alive
+	_, err := d.Dial("tcp", "gitlab.com:80")
+	assert.Nil(t, err)
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"github.com"}, lookups)
+	assert.Equal(t, entry(d, "github.com:80").addrs, []string{"[10.0.0.2]:80"})
+	assert.Equal(t, entry(d, "gitlab.com:80").addrs, []string{"10.0.1.1:80"})
+}
+
+func TestExpiredHostIsResolvedOnce(t *testing.T) {
+	var lookups int64
+	d := withEntries(&Dialer{
+		TTL: defaultTTL,
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		LookupIP: func(host string) ([]net.IP, error) {
+			atomic.AddInt64(&lookups, 1)
+			time.Sleep(10 * time.Millisecond)
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-2 * defaultTTL)},
+	})
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := d.Dial("tcp", "github.com:80")
+			assert.Nil(t, err)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&lookups))
+}
+
+func TestRoundRobinPerHost(t *testing.T) {
+	for _, s := range []SelectionStrategy{nil, &RoundRobin{}} {
+		var usedIPs []string
+		d := withEntries(&Dialer{
+			D: testDialer{d: func(network string, address string) (net.Conn, error) {
+				usedIPs = append(usedIPs, address)
+				return nil, nil
+			}},
+			TTL:      defaultTTL,
+			Strategy: s,
+		}, map[string]*hostEntry{
+			"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+			"gitlab.com:80": {addrs: []string{"10.0.1.1:80", "10.0.1.2:80"}, resolved: time.Now()},
+		})
+
+		for i := 0; i < 3; i++ {
+			d.Dial("tcp", "github.com:80")
+			d.Dial("tcp", "gitlab.com:80")
+		}
+		assert.Equal(t, []string{
+			"10.0.0.2:80", "10.0.1.2:80",
+			"10.0.0.3:80", "10.0.1.1:80",
+			"10.0.0.1:80", "10.0.1.2:80",
+		}, usedIPs)
+	}
+}
+
+type testCNAMEResolver struct {
+	testResolver
+	cnames map[string]string
+}
+
+func (r testCNAMEResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if cname, ok := r.cnames[host]; ok {
+		return cname, nil
+	}
+	return host + ".", nil
+}
+
+func TestMaxCNAMEDepth(t *testing.T) {
+	var looked []string
+	r := testCNAMEResolver{
+		testResolver: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			looked = append(looked, host)
+			if strings.EqualFold(host, "lb.example.net") {
+				return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+			}
+			return nil, errors.New("no such host")
+		},
+		cnames: map[string]string{
+			"github.com":        "www.example.com.",
+			"www.example.com":   "cdn.example.com.",
+			"cdn.example.com":   "LB.example.net.",
+			"loop.example.com":  "loop2.example.com.",
+			"loop2.example.com": "loop.example.com.",
+		},
+	}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:           defaultTTL,
+		Resolver:      r,
+		MaxCNAMEDepth: 3,
+	}
+
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, "[10.0.0.1]:80", addr)
+	assert.Equal(t, []string{"LB.example.net"}, looked)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(d, "github.com:80").addrs)
+
+	d.MaxCNAMEDepth = 2
+	d.Flush()
+	_, err = d.Dial("tcp", "www.example.com:80")
+	assert.Nil(t, err)
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrCNAMEChain)
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+
+	d.MaxCNAMEDepth = 10
+	_, err = d.Dial("tcp", "loop.example.com:80")
+	assert.ErrorIs(t, err, ErrCNAMEChain)
+	assert.ErrorContains(t, err, "loops")
+
+	// without a depth the Resolver is left to deal with CNAMEs
+	d.MaxCNAMEDepth = 0
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.NotNil(t, err)
+}
+
+func TestPortsShareLookup(t *testing.T) {
+	var dialed []string
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	d.Dial("tcp", "github.com:80")
+	d.Dial("tcp", "github.com:443")
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.1]:443"}, dialed)
+	assert.Equal(t, []string{"[10.0.0.1]:443"}, entry(d, "github.com:443").addrs)
+
+	// the other port's entry expires along with the lookup it came from
+	ttl := d.ttl(entry(d, "github.com:443"))
+	assert.True(t, ttl > 0 && ttl <= defaultTTL, ttl)
+
+	// an expired entry is looked up again, for the other ports too
+	entry(d, "github.com:80").resolved = time.Now().Add(-2 * defaultTTL)
+	d.Dial("tcp", "github.com:80")
+	d.Dial("tcp", "github.com:8080")
+	assert.Equal(t, 2, lookups)
+
+	d.Evict("github.com:80")
+	d.Dial("tcp", "github.com:8443")
+	assert.Equal(t, 3, lookups)
+}
+
+func TestDialContextTrace(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address != "10.0.0.3:80" {
+				time.Sleep(time.Millisecond)
+				return nil, errors.New("connection refused")
+			}
+			return client, nil
+		}},
+		TTL:      defaultTTL,
+		Strategy: FirstHealthy{},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+
+	conn, attempts, err := d.DialContextTrace(context.Background(), "tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, client, conn)
+	if assert.Len(t, attempts, 3) {
+		for i, addr := range []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"} {
+			assert.Equal(t, addr, attempts[i].Addr)
+		}
+		assert.ErrorContains(t, attempts[0].Err, "connection refused")
+		assert.ErrorContains(t, attempts[1].Err, "connection refused")
+		assert.Nil(t, attempts[2].Err)
+		assert.True(t, attempts[0].Took >= time.Millisecond)
+		assert.False(t, attempts[1].Start.Before(attempts[0].Start.Add(attempts[0].Took)))
+	}
+
+	// a dial failing before it connects anywhere has no attempts
+	_, attempts, err = d.DialContextTrace(context.Background(), "tcp", "missing")
+	assert.NotNil(t, err)
+	assert.Empty(t, attempts)
+}
+
+func TestIPv6Zones(t *testing.T) {
+	var usedIPs []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			usedIPs = append(usedIPs, address)
+			return nil, nil
+		}},
+		TTL: defaultTTL,
+		Resolver: testResolver(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{
+				{IP: net.ParseIP("fe80::1"), Zone: "eth0"},
+				{IP: net.ParseIP("fe80::1"), Zone: "eth1"},
+				{IP: net.ParseIP("10.0.0.1"), Zone: "eth0"},
+			}, nil
+		}),
+	}
+
+	_, err := d.Dial("tcp", "router.local:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[fe80::1%eth0]:80", "[fe80::1%eth1]:80", "[10.0.0.1]:80"}, entry(d, "router.local:80").addrs)
+	assert.True(t, isIPv6Addr("[fe80::1%eth0]:80"))
+
+	usedIPs = nil
+	_, err = d.Dial("tcp", "[fe80::2%eth0]:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[fe80::2%eth0]:80"}, usedIPs)
+
+	for _, s := range []string{"fe80::1%", "10.0.0.1%eth0", "router.local"} {
+		_, ok := parseIPZone(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	var mx sync.Mutex
+	inFlight, most := 0, 0
+	release := make(chan struct{})
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			mx.Lock()
+			inFlight++
+			if inFlight > most {
+				most = inFlight
+			}
+			mx.Unlock()
+			<-release
+			mx.Lock()
+			inFlight--
+			mx.Unlock()
+			return nil, nil
+		}},
+		TTL:                defaultTTL,
+		MaxConcurrentDials: 2,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d.Dial("tcp", "host"+strconv.Itoa(i)+".example.com:80")
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// with every slot taken, the next dial waits no longer than its context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := d.DialContext(ctx, "tcp", "github.com:80")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotEmpty(t, entry(d, "github.com:80").addrs) // and isn't held against the address
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 2, most)
+}
+
+func TestSortAddrs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::10"),
+		net.ParseIP("10.0.0.20"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("10.0.0.3"),
+		net.ParseIP("9.255.0.1"),
+	}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:              defaultTTL,
+		SortAddrs:        true,
+		ShuffleOnResolve: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+			return ips, nil
+		},
+	}
+
+	for i := 0; i < 5; i++ {
+		addrs, err := d.resolve(context.Background(), "github.com:80")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"[9.255.0.1]:80", "[10.0.0.3]:80", "[10.0.0.20]:80", "[2001:db8::2]:80", "[2001:db8::10]:80",
+		}, addrs)
+	}
+
+	d.PreferIPv6 = true
+	addrs, err := d.resolve(context.Background(), "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"[2001:db8::2]:80", "[2001:db8::10]:80", "[9.255.0.1]:80", "[10.0.0.3]:80", "[10.0.0.20]:80",
+	}, addrs)
+}
@@ -0,0 +1,271 @@
+package cdialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsClassIN   = 1
+
+	ednsPayloadSize  = 4096
+	ednsClientSubnet = 8
+
+	dnsRcodeNXDomain = 3
+)
+
+var errMalformedDNS = errors.New("dialer: malformed DNS message")
+
+// appendDNSQuery appends to b a recursive query for the records of type
+// qtype of name, with an EDNS Client Subnet option for ecs if it's set.
+func appendDNSQuery(b []byte, id uint16, name string, qtype uint16, ecs *net.IPNet) ([]byte, error) {
+	var arcount byte
+	if ecs != nil {
+		arcount = 1
+	}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = append(b, 0x01, 0x00) // recursion desired
+	b = append(b, 0, 1, 0, 0, 0, 0, 0, arcount)
+
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errors.New(`dialer: name "` + name + `" is too long`)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, errors.New(`dialer: invalid name "` + name + `"`)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	b = append(b, 0)
+
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	if ecs != nil {
+		b = appendClientSubnet(b, ecs)
+	}
+	return b, nil
+}
+
+// appendClientSubnet appends an OPT record carrying subnet as an RFC 7871
+// Client Subnet option, with the address cut down to the prefix.
+func appendClientSubnet(b []byte, subnet *net.IPNet) []byte {
+	family, ip := uint16(1), subnet.IP.To4()
+	if ip == nil {
+		family, ip = 2, subnet.IP.To16()
+	}
+	ones, _ := subnet.Mask.Size()
+	addr := ip.Mask(subnet.Mask)[:(ones+7)/8]
+
+	b = append(b, 0) // root
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, ednsPayloadSize)
+	b = append(b, 0, 0, 0, 0) // extended rcode and flags
+	b = binary.BigEndian.AppendUint16(b, uint16(8+len(addr)))
+	b = binary.BigEndian.AppendUint16(b, ednsClientSubnet)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(addr)))
+	b = binary.BigEndian.AppendUint16(b, family)
+	b = append(b, byte(ones), 0)
+	return append(b, addr...)
+}
+
+// parseDNSAnswer returns the addresses of type qtype answering the query
+// with id for name, and the lowest TTL of the answer's records. An answer
+// without any is an error.
+func parseDNSAnswer(msg []byte, id uint16, name string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	off, ancount, err := dnsAnswers(msg, id, name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []net.IPAddr
+	ttl := time.Duration(-1)
+	for i := 0; i < ancount; i++ {
+		if off = skipDNSName(msg, off); off < 0 || off+10 > len(msg) {
+			return nil, 0, errMalformedDNS
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		recTTL := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		n := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+n > len(msg) {
+			return nil, 0, errMalformedDNS
+		}
+		rdata := msg[off : off+n]
+		off += n
+
+		if class != dnsClassIN {
+			continue
+		}
+		if ttl < 0 || recTTL < ttl {
+			ttl = recTTL
+		}
+		switch {
+		case typ != qtype:
+		case typ == dnsTypeA && n == net.IPv4len, typ == dnsTypeAAAA && n == net.IPv6len:
+			addrs = append(addrs, net.IPAddr{IP: append(net.IP(nil), rdata...)})
+		default:
+			return nil, 0, errMalformedDNS
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// parseDNSCNAME returns the CNAME target, ending with a dot, answering
+// the query with id for name. It's name itself if the answer has none.
+func parseDNSCNAME(msg []byte, id uint16, name string) (string, error) {
+	off, ancount, err := dnsAnswers(msg, id, name)
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < ancount; i++ {
+		owner, next := readDNSName(msg, off)
+		if next < 0 || next+10 > len(msg) {
+			return "", errMalformedDNS
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		class := binary.BigEndian.Uint16(msg[next+2:])
+		n := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10
+		if off+n > len(msg) {
+			return "", errMalformedDNS
+		}
+		if typ == dnsTypeCNAME && class == dnsClassIN && canonicalName(owner) == canonicalName(name) {
+			target, end := readDNSName(msg, off)
+			if end < 0 || end > off+n {
+				return "", errMalformedDNS
+			}
+			return target + ".", nil
+		}
+		off += n
+	}
+	return name, nil
+}
+
+// dnsAnswers checks that msg answers the query with id for name, and
+// returns the offset of its answer records and how many there are.
+func dnsAnswers(msg []byte, id uint16, name string) (int, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id || msg[2]&0x80 == 0 {
+		return 0, 0, errMalformedDNS
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case dnsRcodeNXDomain:
+		return 0, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return 0, 0, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	for i := 0; i < int(qdcount); i++ {
+		if off = skipDNSName(msg, off); off < 0 || off+4 > len(msg) {
+			return 0, 0, errMalformedDNS
+		}
+		off += 4
+	}
+	return off, int(ancount), nil
+}
+
+// skipDNSName returns the offset in msg past the name at off, or -1 if it
+// runs out of msg.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1
+		case n&0xc0 == 0xc0: // compression pointer, which ends the name
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		}
+		off += 1 + n
+	}
+	return -1
+}
+
+// readDNSName returns the name at off in msg, without its final dot, and
+// the offset past it, or -1 if it's malformed.
+func readDNSName(msg []byte, off int) (string, int) {
+	var labels []string
+	end := -1
+	for hops := 0; off < len(msg) && hops < 64; {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return "", -1
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			hops++
+			continue
+		}
+		if off+1+n > len(msg) {
+			return "", -1
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += 1 + n
+	}
+	return "", -1
+}
+
+// lookupBothFamilies looks up the A and AAAA records of host at the same
+// time with query, and merges what they found. It only fails if both do.
+func lookupBothFamilies(ctx context.Context, host string, query func(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error)) ([]net.IPAddr, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, 0, nil
+	}
+
+	type answer struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	aaaa := make(chan answer, 1)
+	go func() {
+		addrs, ttl, err := query(ctx, host, dnsTypeAAAA)
+		aaaa <- answer{addrs, ttl, err}
+	}()
+	addrs, ttl, err := query(ctx, host, dnsTypeA)
+	a6 := <-aaaa
+
+	switch {
+	case err != nil && a6.err != nil:
+		return nil, 0, err
+	case err != nil:
+		return a6.addrs, a6.ttl, nil
+	case a6.err != nil:
+		return addrs, ttl, nil
+	}
+	if a6.ttl < ttl {
+		ttl = a6.ttl
+	}
+	return append(addrs, a6.addrs...), ttl, nil
+}
@@ -0,0 +1,86 @@
+package cdialer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// maxDNSMessage is the largest DNS message there is.
+const maxDNSMessage = 65535
+
+// DoHResolver is a TTLResolver querying a DNS-over-HTTPS endpoint, like
+// https://cloudflare-dns.com/dns-query, in the RFC 8484 wire format. To
+// resolve through it, set it as a Dialer's Resolver; Client must then not
+// dial through that same Dialer, or the endpoint's host could never be
+// looked up.
+type DoHResolver struct {
+	URL    string
+	Client *http.Client // http.DefaultClient when nil
+
+	// ClientSubnet, if set, is sent along with every query as EDNS Client
+	// Subnet, for the server to answer as it would clients in it.
+	ClientSubnet *net.IPNet
+}
+
+func (r *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func (r *DoHResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupBothFamilies(ctx, host, r.query)
+}
+
+// LookupCNAME returns the CNAME of host, a single hop of its chain.
+func (r *DoHResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	msg, err := r.exchange(ctx, host, dnsTypeCNAME)
+	if err != nil {
+		return "", err
+	}
+	return parseDNSCNAME(msg, 0, host)
+}
+
+func (r *DoHResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	msg, err := r.exchange(ctx, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswer(msg, 0, host, qtype)
+}
+
+// exchange sends the query for the records of type qtype of host and
+// returns the answer.
+func (r *DoHResolver) exchange(ctx context.Context, host string, qtype uint16) ([]byte, error) {
+	// RFC 8484 asks for ID 0, so that HTTP caches can serve the answer
+	q, err := appendDNSQuery(nil, 0, host, qtype, r.ClientSubnet)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(`dialer: DoH query for "` + host + `" failed: ` + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage))
+}
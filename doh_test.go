@@ -0,0 +1,215 @@
+package cdialer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRR struct {
+	typ uint16
+	ttl uint32
+	ip  string // the target name of CNAMEs
+}
+
+// testDNSAnswer answers query with the records zone has for its name, all
+// of them whatever their type, or with NXDOMAIN if there are none.
+func testDNSAnswer(query []byte, zone map[string][]testRR) []byte {
+	var labels []string
+	off := 12
+	for query[off] != 0 {
+		n := int(query[off])
+		labels = append(labels, string(query[off+1:off+1+n]))
+		off += 1 + n
+	}
+	question := query[12 : off+5]
+
+	rrs, ok := zone[strings.Join(labels, ".")]
+	msg := append([]byte(nil), query[:2]...)
+	if ok {
+		msg = append(msg, 0x81, 0x80)
+	} else {
+		msg = append(msg, 0x81, 0x83)
+	}
+	msg = append(msg, 0, 1, 0, byte(len(rrs)), 0, 0, 0, 0)
+	msg = append(msg, question...)
+	for _, rr := range rrs {
+		var rdata []byte
+		switch rr.typ {
+		case dnsTypeCNAME:
+			for _, label := range strings.Split(rr.ip, ".") {
+				rdata = append(append(rdata, byte(len(label))), label...)
+			}
+			rdata = append(rdata, 0)
+		case dnsTypeA:
+			rdata = net.ParseIP(rr.ip).To4()
+		default:
+			rdata = net.ParseIP(rr.ip)
+		}
+		msg = append(msg, 0xc0, 12) // the question's name
+		msg = binary.BigEndian.AppendUint16(msg, rr.typ)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		msg = binary.BigEndian.AppendUint32(msg, rr.ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func testDoHServer(zone map[string][]testRR) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/broken") {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(testDNSAnswer(query, zone))
+	}))
+}
+
+func TestDoHResolver(t *testing.T) {
+	srv := testDoHServer(map[string][]testRR{
+		"github.com": {
+			{dnsTypeA, 300, "10.0.0.1"},
+			{dnsTypeA, 60, "10.0.0.2"},
+			{dnsTypeAAAA, 120, "2001:db8::1"},
+		},
+		"v4.example.com":    {{dnsTypeA, 30, "10.0.0.3"}},
+		"empty.example.com": {},
+	})
+	defer srv.Close()
+	r := &DoHResolver{URL: srv.URL + "/dns-query", Client: srv.Client()}
+
+	addrs, ttl, err := r.LookupIPAddrTTL(context.Background(), "github.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1").To4()},
+		{IP: net.ParseIP("10.0.0.2").To4()},
+		{IP: net.ParseIP("2001:db8::1")},
+	}, addrs)
+	assert.Equal(t, 60*time.Second, ttl)
+
+	addrs, ttl, err = r.LookupIPAddrTTL(context.Background(), "v4.example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("10.0.0.3").To4()}}, addrs)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	for _, host := range []string{"empty.example.com", "gitlab.com"} {
+		_, err = r.LookupIPAddr(context.Background(), host)
+		var dnsErr *net.DNSError
+		if assert.ErrorAs(t, err, &dnsErr, host) {
+			assert.True(t, dnsErr.IsNotFound, host)
+		}
+	}
+
+	r.URL = srv.URL + "/broken"
+	_, err = r.LookupIPAddr(context.Background(), "github.com")
+	assert.ErrorContains(t, err, "500")
+}
+
+func TestDoHClientSubnet(t *testing.T) {
+	var queries [][]byte
+	var mx sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		mx.Lock()
+		queries = append(queries, query)
+		mx.Unlock()
+		w.Write(testDNSAnswer(query, map[string][]testRR{
+			"github.com": {{dnsTypeA, 300, "10.0.0.1"}},
+		}))
+	}))
+	defer srv.Close()
+
+	_, subnet, _ := net.ParseCIDR("198.51.100.77/24")
+	r := &DoHResolver{URL: srv.URL, Client: srv.Client(), ClientSubnet: subnet}
+	_, err := r.LookupIPAddr(context.Background(), "github.com")
+	assert.Nil(t, err)
+
+	if assert.Len(t, queries, 2) {
+		for _, q := range queries {
+			assert.Equal(t, []byte{0, 1}, q[10:12]) // ARCOUNT
+			assert.Equal(t, []byte{
+				0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 11, // root OPT, 4096 bytes, 11 bytes of options
+				0, 8, 0, 7, 0, 1, 24, 0, 198, 51, 100, // Client Subnet, IPv4 /24
+			}, q[len(q)-22:])
+		}
+	}
+
+	_, subnet, _ = net.ParseCIDR("2001:db8:abcd::/36")
+	q, err := appendDNSQuery(nil, 0, "github.com", dnsTypeAAAA, subnet)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 8, 0, 9, 0, 2, 36, 0, 0x20, 0x01, 0x0d, 0xb8, 0xa0}, q[len(q)-13:])
+}
+
+func TestDialerWithDoHResolver(t *testing.T) {
+	srv := testDoHServer(map[string][]testRR{
+		"github.com": {{dnsTypeA, 300, "10.0.0.1"}},
+	})
+	defer srv.Close()
+
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return nil, nil
+		}},
+		TTL:      defaultTTL,
+		Resolver: &DoHResolver{URL: srv.URL, Client: srv.Client()},
+	}
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, dialed)
+	assert.Equal(t, 300*time.Second, d.ttl(entry(d, "github.com:80")))
+}
+
+func TestDoHCNAME(t *testing.T) {
+	srv := testDoHServer(map[string][]testRR{
+		"a.example.com": {{dnsTypeCNAME, 300, "b.example.com"}},
+		"b.example.com": {{dnsTypeCNAME, 300, "c.example.com"}},
+		"c.example.com": {{dnsTypeA, 300, "10.0.0.1"}},
+	})
+	defer srv.Close()
+	r := &DoHResolver{URL: srv.URL, Client: srv.Client()}
+
+	// a single hop at a time
+	cname, err := r.LookupCNAME(context.Background(), "a.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "b.example.com.", cname)
+	cname, err = r.LookupCNAME(context.Background(), "c.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "c.example.com", cname)
+
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return nil, nil
+		}},
+		TTL:           defaultTTL,
+		Resolver:      r,
+		MaxCNAMEDepth: 1,
+	}
+	_, err = d.Dial("tcp", "a.example.com:80")
+	assert.ErrorIs(t, err, ErrCNAMEChain)
+
+	d.MaxCNAMEDepth = 2
+	_, err = d.Dial("tcp", "a.example.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, dialed)
+}
@@ -0,0 +1,169 @@
+package cdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDoTPort    = "853"
+	defaultDoTTimeout = 5 * time.Second
+	maxDoTIdleConns   = 4
+)
+
+// DoTResolver is a TTLResolver querying a DNS-over-TLS server. It keeps
+// the connections it opened around for the next lookups.
+type DoTResolver struct {
+	// Addr is the server's address, port 853 unless it has one.
+	Addr string
+	// TLSConfig, if set, is used to connect, with ServerName defaulting to
+	// Addr's host.
+	TLSConfig *tls.Config
+	// Timeout bounds each query when the lookup's context has no
+	// deadline. It's 5s when zero.
+	Timeout time.Duration
+	// ClientSubnet is as for DoHResolver.
+	ClientSubnet *net.IPNet
+
+	mx   sync.Mutex
+	idle []net.Conn
+}
+
+func (r *DoTResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func (r *DoTResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return lookupBothFamilies(ctx, host, r.query)
+}
+
+// Close closes the idle connections.
+func (r *DoTResolver) Close() error {
+	r.mx.Lock()
+	idle := r.idle
+	r.idle = nil
+	r.mx.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
+
+// LookupCNAME returns the CNAME of host, a single hop of its chain.
+func (r *DoTResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	msg, id, err := r.exchange(ctx, host, dnsTypeCNAME)
+	if err != nil {
+		return "", err
+	}
+	return parseDNSCNAME(msg, id, host)
+}
+
+func (r *DoTResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	msg, id, err := r.exchange(ctx, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSAnswer(msg, id, host, qtype)
+}
+
+// exchange sends the query for the records of type qtype of host and
+// returns the answer and the query's ID.
+func (r *DoTResolver) exchange(ctx context.Context, host string, qtype uint16) ([]byte, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	q, err := appendDNSQuery([]byte{0, 0}, id, host, qtype, r.ClientSubnet)
+	if err != nil {
+		return nil, 0, err
+	}
+	binary.BigEndian.PutUint16(q, uint16(len(q)-2))
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := r.Timeout
+		if timeout <= 0 {
+			timeout = defaultDoTTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+
+	conn, reused := r.take()
+	for {
+		if conn == nil {
+			if conn, err = r.dial(ctx); err != nil {
+				return nil, 0, err
+			}
+		}
+		msg, err := exchangeDoT(conn, deadline, q)
+		if err == nil {
+			r.put(conn)
+			return msg, id, nil
+		}
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, 0, err
+		}
+		// the server may have closed the connection while it sat idle
+		conn, reused = nil, false
+	}
+}
+
+func (r *DoTResolver) dial(ctx context.Context) (net.Conn, error) {
+	addr := r.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultDoTPort)
+	}
+	d := &tls.Dialer{Config: r.TLSConfig}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// exchangeDoT sends the length-prefixed query q over conn and reads the
+// reply.
+func exchangeDoT(conn net.Conn, deadline time.Time, q []byte) ([]byte, error) {
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (r *DoTResolver) take() (net.Conn, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if len(r.idle) == 0 {
+		return nil, false
+	}
+	conn := r.idle[len(r.idle)-1]
+	r.idle = r.idle[:len(r.idle)-1]
+	return conn, true
+}
+
+func (r *DoTResolver) put(conn net.Conn) {
+	r.mx.Lock()
+	if len(r.idle) < maxDoTIdleConns {
+		r.idle = append(r.idle, conn)
+		conn = nil
+	}
+	r.mx.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
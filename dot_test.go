@@ -0,0 +1,112 @@
+package cdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDoTServer serves zone over DNS-over-TLS, returning its address, the
+// TLS config to trust it and a count of the connections it accepted.
+func testDoTServer(t *testing.T, zone map[string][]testRR) (string, *tls.Config, *int32) {
+	l, config := testTLSListener(t)
+
+	var conns int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				for {
+					var n [2]byte
+					if _, err := io.ReadFull(conn, n[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(n[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					msg := testDNSAnswer(query, zone)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), config, &conns
+}
+
+func TestDoTResolver(t *testing.T) {
+	addr, config, conns := testDoTServer(t, map[string][]testRR{
+		"github.com": {
+			{dnsTypeA, 300, "10.0.0.1"},
+			{dnsTypeAAAA, 120, "2001:db8::1"},
+		},
+		"www.github.com": {{dnsTypeCNAME, 300, "github.com"}},
+	})
+	r := &DoTResolver{Addr: addr, TLSConfig: config}
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		addrs, ttl, err := r.LookupIPAddrTTL(context.Background(), "github.com")
+		assert.Nil(t, err)
+		assert.Equal(t, []net.IPAddr{
+			{IP: net.ParseIP("10.0.0.1").To4()},
+			{IP: net.ParseIP("2001:db8::1")},
+		}, addrs)
+		assert.Equal(t, 120*time.Second, ttl)
+	}
+	// the A and AAAA queries run side by side, on a connection each
+	assert.True(t, atomic.LoadInt32(conns) <= 2, atomic.LoadInt32(conns))
+
+	_, err := r.LookupIPAddr(context.Background(), "gitlab.com")
+	assert.NotNil(t, err)
+
+	cname, err := r.LookupCNAME(context.Background(), "www.github.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "github.com.", cname)
+
+	// idle connections the server dropped are replaced
+	r.mx.Lock()
+	for _, conn := range r.idle {
+		conn.(*tls.Conn).NetConn().Close()
+	}
+	r.mx.Unlock()
+	_, err = r.LookupIPAddr(context.Background(), "github.com")
+	assert.Nil(t, err)
+
+	r = &DoTResolver{Addr: addr}
+	_, err = r.LookupIPAddr(context.Background(), "github.com")
+	assert.NotNil(t, err) // the certificate isn't trusted
+}
+
+func TestDialerWithDoTResolver(t *testing.T) {
+	addr, config, _ := testDoTServer(t, map[string][]testRR{
+		"github.com": {{dnsTypeA, 300, "10.0.0.1"}},
+	})
+
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return nil, nil
+		}},
+		TTL:      defaultTTL,
+		Resolver: &DoTResolver{Addr: addr, TLSConfig: config},
+	}
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, dialed)
+	assert.Equal(t, 300*time.Second, d.ttl(entry(d, "github.com:80")))
+}
@@ -0,0 +1,50 @@
+package cdialer
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup makes concurrent lookups of the same key share one call.
+type flightGroup struct {
+	mx      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	addrs []string
+	err   error
+}
+
+// do calls fn unless a call for key is already in flight, in which case
+// it waits for that one and reports its results as shared. Waiting stops
+// when ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]string, error)) (addrs []string, err error, shared bool) {
+	g.mx.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mx.Unlock()
+		select {
+		case <-f.done:
+			return f.addrs, f.err, true
+		case <-ctx.Done():
+			return nil, ctx.Err(), false
+		}
+	}
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mx.Unlock()
+
+	defer func() {
+		g.mx.Lock()
+		delete(g.flights, key)
+		g.mx.Unlock()
+		close(f.done)
+	}()
+
+	f.addrs, f.err = fn()
+	return f.addrs, f.err, false
+}
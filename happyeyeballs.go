@@ -0,0 +1,154 @@
+package cdialer
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const defaultFallbackDelay = 300 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	addr string
+	err  error
+}
+
+// dialParallel dials addrs Happy Eyeballs style, starting with first. Every
+// address that fails is evicted on its own, as a sequential dial would.
+func (d *Dialer) dialParallel(ctx context.Context, network string, e *hostEntry, key, first string, addrs []string) (net.Conn, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := d.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+
+	candidates := interleaveFamilies(first, addrs)
+	if d.MaxAttempts > 0 && d.MaxAttempts < len(candidates) {
+		candidates = candidates[:d.MaxAttempts]
+	}
+	results := make(chan dialResult, len(candidates))
+	next, pending := 0, 0
+	var fallback <-chan time.Time
+
+	// launch starts dialing the next candidate whose breaker allows it, if
+	// any is left
+	launch := func() {
+		fallback = nil
+		for next < len(candidates) {
+			addr := candidates[next]
+			next++
+			if !d.breakerAllows(e, addr, time.Now()) {
+				continue
+			}
+			pending++
+			go func() {
+				conn, err := d.timedDial(ctx, network, addr)
+				results <- dialResult{conn, addr, err}
+			}()
+			if next < len(candidates) {
+				fallback = time.After(delay)
+			}
+			return
+		}
+	}
+	launch()
+	if pending == 0 {
+		return nil, "", errBreakersOpen(key)
+	}
+
+	var failed []string
+	var errs []error
+	remaining := len(addrs)
+	for pending > 0 {
+		select {
+		case <-fallback:
+			launch()
+
+		case r := <-results:
+			pending--
+			d.noteResult(e, r.addr, r.err)
+			if r.err == nil {
+				cancel()
+				go closeLosers(results, pending)
+				return r.conn, r.addr, nil
+			}
+
+			failed = append(failed, r.addr)
+			errs = append(errs, r.err)
+			if d.shouldEvict(r.err) {
+				remaining = d.evictAddr(key, r.addr, r.err)
+			}
+			if next < len(candidates) && ctx.Err() == nil {
+				launch()
+			}
+
+		case <-ctx.Done():
+			go closeLosers(results, pending)
+			return nil, "", ctx.Err()
+		}
+	}
+
+	err := joinDialErrors(failed, errs)
+	if remaining == 0 {
+		if d.ReresolveOnEmpty {
+			d.reresolve(ctx, key)
+		}
+		return nil, "", &dialError{ErrAllAddrsUnreachable, err}
+	}
+	return nil, "", err
+}
+
+// closeLosers closes the connections of dials that were still in flight
+// when another one won.
+func closeLosers(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies orders addrs starting with first and then in cache
+// order, alternating between IPv6 and IPv4 addresses as long as both are
+// left.
+func interleaveFamilies(first string, addrs []string) []string {
+	start := 0
+	for i, a := range addrs {
+		if a == first {
+			start = i
+			break
+		}
+	}
+
+	var same, other []string
+	firstIsIPv6 := isIPv6Addr(addrs[start])
+	for i := range addrs {
+		a := addrs[(start+i)%len(addrs)]
+		if isIPv6Addr(a) == firstIsIPv6 {
+			same = append(same, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+
+	out := make([]string, 0, len(addrs))
+	for len(same) > 0 || len(other) > 0 {
+		if len(same) > 0 {
+			out = append(out, same[0])
+			same = same[1:]
+		}
+		if len(other) > 0 {
+			out = append(out, other[0])
+			other = other[1:]
+		}
+	}
+	return out
+}
+
+func isIPv6Addr(addr string) bool {
+	ip, ok := parseIPZone(addrIP(addr))
+	return ok && ip.IP.To4() == nil
+}
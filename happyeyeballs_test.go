@@ -0,0 +1,117 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func happyEyeballsDialer(dc func(ctx context.Context, network, address string) (net.Conn, error), addrs ...string) *Dialer {
+	return withEntries(&Dialer{
+		D:             testContextDialer{dc: dc},
+		TTL:           defaultTTL,
+		Strategy:      FirstHealthy{},
+		HappyEyeballs: true,
+		FallbackDelay: 10 * time.Millisecond,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: addrs, resolved: time.Now()},
+	})
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := []string{"[2001:db8::1]:80", "[2001:db8::2]:80", "[10.0.0.1]:80", "[10.0.0.2]:80", "[10.0.0.3]:80"}
+
+	assert.Equal(t, []string{
+		"[2001:db8::1]:80", "[10.0.0.1]:80", "[2001:db8::2]:80", "[10.0.0.2]:80", "[10.0.0.3]:80",
+	}, interleaveFamilies("[2001:db8::1]:80", addrs))
+	assert.Equal(t, []string{
+		"[10.0.0.2]:80", "[2001:db8::1]:80", "[10.0.0.3]:80", "[2001:db8::2]:80", "[10.0.0.1]:80",
+	}, interleaveFamilies("[10.0.0.2]:80", addrs))
+}
+
+func TestHappyEyeballsFallsBackToNextAddr(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	d := happyEyeballsDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "[2001:db8::1]:80" {
+			<-ctx.Done() // black-holed
+			return nil, ctx.Err()
+		}
+		return client, nil
+	}, "[2001:db8::1]:80", "[10.0.0.1]:80")
+
+	start := time.Now()
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, client, conn)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestHappyEyeballsEvictsFailedAddrs(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	d := happyEyeballsDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "[10.0.0.3]:80" {
+			return client, nil
+		}
+		return nil, errors.New("connection refused")
+	}, "[10.0.0.1]:80", "[10.0.0.2]:80", "[10.0.0.3]:80")
+
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, client, conn)
+	assert.Equal(t, []string{"[10.0.0.3]:80"}, entry(d, "github.com:80").addrs)
+
+	d = happyEyeballsDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}, "[10.0.0.1]:80", "[10.0.0.2]:80")
+
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.ErrorIs(t, err, ErrAllAddrsUnreachable)
+	assert.Empty(t, entry(d, "github.com:80").addrs)
+}
+
+func TestHappyEyeballsClosesLosers(t *testing.T) {
+	var mx sync.Mutex
+	var closed []net.Conn
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	d := happyEyeballsDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		server, client := net.Pipe()
+		go func() {
+			// the pipe's far end sees EOF once the dialer closes the conn
+			server.Read(make([]byte, 1))
+			mx.Lock()
+			closed = append(closed, client)
+			mx.Unlock()
+			if address == "[10.0.0.1]:80" {
+				close(done)
+			}
+		}()
+		if address == "[10.0.0.1]:80" {
+			<-release // connects, but only after the fallback won
+		}
+		return client, nil
+	}, "[10.0.0.1]:80", "[10.0.0.2]:80")
+
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("losing connection wasn't closed")
+	}
+	mx.Lock()
+	assert.NotContains(t, closed, conn)
+	mx.Unlock()
+}
@@ -0,0 +1,33 @@
+package cdialer
+
+import (
+	"net/http"
+	"time"
+)
+
+const defaultClientTimeout = 30 * time.Second
+
+// HTTPTransport returns a clone of base, or of http.DefaultTransport when
+// base is nil, that dials through d. Everything else, TLS settings
+// included, is kept as base has it. Unless base disables keep-alives, idle
+// connections are reused as usual and d only picks addresses for new ones,
+// so set Affinity to keep those on the address that last worked.
+func (d *Dialer) HTTPTransport(base *http.Transport) *http.Transport {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	t := base.Clone()
+	t.DialContext = d.DialContext
+	return t
+}
+
+// Client returns an http.Client dialing through d over a clone of
+// http.DefaultTransport, with its keep-alive and idle connection
+// settings, and a 30s overall request timeout. It's a new client every
+// time, so change whatever doesn't suit.
+func (d *Dialer) Client() *http.Client {
+	return &http.Client{
+		Transport: d.HTTPTransport(nil),
+		Timeout:   defaultClientTimeout,
+	}
+}
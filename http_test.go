@@ -0,0 +1,99 @@
+package cdialer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	base := &http.Transport{
+		TLSClientConfig:   &tls.Config{ServerName: "example.com"},
+		DisableKeepAlives: true,
+	}
+	d := &Dialer{TTL: defaultTTL}
+
+	tr := d.HTTPTransport(base)
+	assert.NotNil(t, tr.DialContext)
+	assert.Nil(t, base.DialContext)
+	assert.Equal(t, "example.com", tr.TLSClientConfig.ServerName)
+	assert.True(t, tr.DisableKeepAlives)
+
+	tr = d.HTTPTransport(nil)
+	assert.NotNil(t, tr.DialContext)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConns, tr.MaxIdleConns)
+}
+
+func ExampleDialer_HTTPTransport() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	d := &Dialer{
+		TTL: DefaultTTL(),
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+	}
+	client := &http.Client{Transport: d.HTTPTransport(nil)}
+
+	resp, err := client.Get("http://service.internal:" + port + "/")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(string(body))
+	// Output: hello
+}
+
+func TestClient(t *testing.T) {
+	d := &Dialer{TTL: defaultTTL}
+
+	c := d.Client()
+	assert.Equal(t, defaultClientTimeout, c.Timeout)
+	assert.NotNil(t, c.Transport.(*http.Transport).DialContext)
+
+	c.Timeout = time.Second
+	assert.Equal(t, defaultClientTimeout, d.Client().Timeout)
+}
+
+func ExampleDialer_Client() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	lookups := 0
+	d := &Dialer{
+		TTL: DefaultTTL(),
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+	}
+	client := d.Client()
+	client.Transport.(*http.Transport).DisableKeepAlives = true // dial for every request
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://service.internal:" + port + "/")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		resp.Body.Close()
+	}
+	fmt.Println("lookups:", lookups)
+	// Output: lookups: 1
+}
@@ -0,0 +1,97 @@
+package cdialer
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// lookupLimiter is a token bucket holding up to a second's worth of
+// lookups, refilled at MaxLookupsPerSecond.
+type lookupLimiter struct {
+	mx     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token and returns how long to wait before using it. When
+// the bucket is empty and wait is false, it takes nothing and reports
+// false.
+func (l *lookupLimiter) take(rate float64, now time.Time, wait bool) (time.Duration, bool) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	burst := math.Max(1, rate)
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = math.Min(burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !wait {
+		return 0, false
+	}
+	l.tokens--
+	return time.Duration(-l.tokens / rate * float64(time.Second)), true
+}
+
+// giveBack returns a token taken for a lookup that didn't happen.
+func (l *lookupLimiter) giveBack() {
+	l.mx.Lock()
+	l.tokens++
+	l.mx.Unlock()
+}
+
+// allowLookup waits until MaxLookupsPerSecond allows another lookup, or
+// ctx is done. With stale addresses to fall back on it doesn't wait at all
+// and reports false instead.
+func (d *Dialer) allowLookup(ctx context.Context, stale bool) (bool, error) {
+	if d.MaxLookupsPerSecond <= 0 {
+		return true, nil
+	}
+
+	wait, ok := d.limiter.take(d.MaxLookupsPerSecond, time.Now(), !stale)
+	if !ok {
+		return false, nil
+	}
+	if wait <= 0 {
+		return true, nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true, nil
+	case <-ctx.Done():
+		d.limiter.giveBack()
+		return false, ctx.Err()
+	}
+}
+
+// dialSemaphore bounds the connection attempts in flight. It's sized on
+// first use.
+type dialSemaphore struct {
+	once  sync.Once
+	slots chan struct{}
+}
+
+func (s *dialSemaphore) acquire(ctx context.Context, n int) error {
+	s.once.Do(func() { s.slots = make(chan struct{}, n) })
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *dialSemaphore) release() {
+	<-s.slots
+}
@@ -0,0 +1,73 @@
+package cdialer
+
+import (
+	"reflect"
+	"time"
+)
+
+// Option configures a Dialer made by NewDialer.
+type Option func(*Dialer)
+
+// NewDialer returns a Dialer with default settings, dialing through a
+// *net.Dialer, with opts applied on top. Like for any Dialer without a D,
+// the *net.Dialer is only made at the first dial, from ConnectTimeout and
+// KeepAlive as they are then.
+func NewDialer(opts ...Option) *Dialer {
+	d := &Dialer{
+		TTL:         defaultTTL,
+		NegativeTTL: defaultNegativeTTL,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// WithDialer makes the Dialer connect through d.
+func WithDialer(d dialer) Option {
+	return func(dl *Dialer) { dl.D = d }
+}
+
+// WithTTL sets TTL.
+func WithTTL(ttl time.Duration) Option {
+	return func(d *Dialer) { d.TTL = ttl }
+}
+
+// WithResolver sets Resolver.
+func WithResolver(r Resolver) Option {
+	return func(d *Dialer) { d.Resolver = r }
+}
+
+// WithExcludeIPv6 sets ExcludeIPv6.
+func WithExcludeIPv6() Option {
+	return func(d *Dialer) { d.ExcludeIPv6 = true }
+}
+
+// WithStrategy sets Strategy.
+func WithStrategy(s SelectionStrategy) Option {
+	return func(d *Dialer) { d.Strategy = s }
+}
+
+// WithMaxAddrs sets MaxAddrs.
+func WithMaxAddrs(n int) Option {
+	return func(d *Dialer) { d.MaxAddrs = n }
+}
+
+// Clone returns a Dialer with the same settings as d and none of its
+// state: its cache starts empty, and so do its counters, rate limits and
+// health tracking. Settings that are pointers or interfaces, like
+// Strategy, Store or TLSConfig, still point to the same values.
+func (d *Dialer) Clone() *Dialer {
+	d.mx.RLock() // for SetTTL
+	defer d.mx.RUnlock()
+
+	c := &Dialer{}
+	src, dst := reflect.ValueOf(d).Elem(), reflect.ValueOf(c).Elem()
+	for i, n := 0, src.NumField(); i < n; i++ {
+		// every exported field is a setting, and every unexported one state
+		if src.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return c
+}
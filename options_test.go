@@ -0,0 +1,77 @@
+package cdialer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDialerDefaults(t *testing.T) {
+	d := NewDialer()
+	assert.Equal(t, DefaultTTL(), d.TTL)
+	assert.Empty(t, d.Snapshot())
+	assert.Nil(t, d.D) // made at the first dial
+	assert.Nil(t, d.Resolver)
+}
+
+func TestNewDialerOptions(t *testing.T) {
+	dial := &net.Dialer{Timeout: time.Second}
+	r := &net.Resolver{}
+	d := NewDialer(
+		WithDialer(dial),
+		WithTTL(time.Minute),
+		WithResolver(r),
+		WithExcludeIPv6(),
+		WithStrategy(FirstHealthy{}),
+		WithMaxAddrs(3),
+		WithTTL(2*time.Minute),
+	)
+
+	assert.Same(t, dial, d.D)
+	assert.Equal(t, 2*time.Minute, d.TTL)
+	assert.Same(t, r, d.Resolver)
+	assert.True(t, d.ExcludeIPv6)
+	assert.Equal(t, FirstHealthy{}, d.Strategy)
+	assert.Equal(t, 3, d.MaxAddrs)
+
+	d = Wrap(dial)
+	assert.Same(t, dial, d.D)
+	assert.Equal(t, DefaultTTL(), d.TTL)
+}
+
+func TestClone(t *testing.T) {
+	lookups := 0
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL: time.Minute,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+	}
+	d.Dial("tcp", "github.com:80")
+
+	c := d.Clone()
+	assert.Equal(t, time.Minute, c.TTL)
+	assert.Empty(t, c.Snapshot())
+	assert.Equal(t, Stats{}, c.Stats())
+
+	c.TTL = time.Hour
+	c.ExcludeIPv6 = true
+	c.Dial("tcp", "github.com:80")
+	assert.Equal(t, 2, lookups)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(c, "github.com:80").addrs)
+
+	// the original is left as it was
+	assert.Equal(t, time.Minute, d.TTL)
+	assert.False(t, d.ExcludeIPv6)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[2001:db8::1]:80"}, entry(d, "github.com:80").addrs)
+	assert.Equal(t, int64(1), d.Stats().DialSuccesses)
+
+	c.Evict("github.com:80")
+	assert.Len(t, d.Snapshot(), 1)
+}
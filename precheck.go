@@ -0,0 +1,72 @@
+package cdialer
+
+import "context"
+
+// precheck returns r with only the addresses that accept a TCP connection
+// within PrecheckTimeout, or r as is if none do. All of them are probed
+// at once, as far as MaxConcurrentDials allows. Probes outlive ctx,
+// whose deadline says nothing about the addresses, but if it's done
+// before they're over r is returned as is.
+func (d *Dialer) precheck(ctx context.Context, r lookupResult) lookupResult {
+	if d.PrecheckTimeout <= 0 || len(r.addrs) == 0 {
+		return r
+	}
+	d.initDialer()
+
+	probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.PrecheckTimeout)
+	defer cancel()
+
+	// results are only waited for until probeCtx is done, as dialers
+	// without DialContext can't be stopped; their late connections get
+	// closed
+	results := make(chan int, len(r.addrs))
+	for i, addr := range r.addrs {
+		go func(i int, addr string) {
+			if !d.probe(probeCtx, addr) {
+				i = -1
+			}
+			results <- i
+		}(i, addr)
+	}
+
+	reachable := make([]bool, len(r.addrs))
+wait:
+	for range r.addrs {
+		select {
+		case i := <-results:
+			if i >= 0 {
+				reachable[i] = true
+			}
+		case <-probeCtx.Done():
+			break wait
+		case <-ctx.Done():
+			return r
+		}
+	}
+
+	addrs := make([]string, 0, len(r.addrs))
+	for i, addr := range r.addrs {
+		if reachable[i] {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 0 {
+		r.addrs = addrs
+	}
+	return r
+}
+
+// probe reports whether addr accepts a TCP connection.
+func (d *Dialer) probe(ctx context.Context, addr string) bool {
+	if d.MaxConcurrentDials > 0 {
+		if err := d.dialSlots.acquire(ctx, d.MaxConcurrentDials); err != nil {
+			return false
+		}
+		defer d.dialSlots.release()
+	}
+	conn, err := d.dialAddr(ctx, "tcp", addr)
+	if conn != nil {
+		conn.Close()
+	}
+	return err == nil
+}
@@ -0,0 +1,126 @@
+package cdialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrecheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// nothing listens on the other loopback addresses
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.3")}
+	d := &Dialer{
+		TTL:             defaultTTL,
+		PrecheckTimeout: time.Second,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return ips, nil
+		},
+	}
+
+	conn, addr, err := d.DialContextAddr(context.Background(), "tcp", "github.com:"+port)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, "[127.0.0.1]:"+port, addr)
+	assert.Equal(t, []string{"[127.0.0.1]:" + port}, entry(d, "github.com:"+port).addrs)
+
+	// when none is reachable, they're all kept
+	l.Close()
+	assert.NoError(t, d.Refresh("github.com:"+port))
+	assert.Len(t, entry(d, "github.com:"+port).addrs, 3)
+}
+
+func TestPrecheckWithoutDialContext(t *testing.T) {
+	release := make(chan struct{})
+	late := make(chan net.Conn, 1)
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address != "[10.0.0.1]:80" {
+				return nil, nil
+			}
+			<-release
+			server, client := net.Pipe()
+			late <- server
+			return client, nil
+		}},
+		TTL:             defaultTTL,
+		PrecheckTimeout: 50 * time.Millisecond,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+
+	// the blackholed address doesn't hold the resolution up
+	start := time.Now()
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "[10.0.0.2]:80", addr)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, []string{"[10.0.0.2]:80"}, entry(d, "github.com:80").addrs)
+
+	// and the connection it makes afterwards is closed
+	close(release)
+	server := <-late
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPrecheckLimitsAndContext(t *testing.T) {
+	var mx sync.Mutex
+	inFlight, peak := 0, 0
+	slow := make(chan struct{})
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			mx.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mx.Unlock()
+			if address == "[10.0.0.1]:80" {
+				<-slow
+			} else {
+				time.Sleep(5 * time.Millisecond)
+			}
+			mx.Lock()
+			inFlight--
+			mx.Unlock()
+			return nil, nil
+		}},
+		PrecheckTimeout:    time.Second,
+		MaxConcurrentDials: 1,
+	}
+	r := lookupResult{addrs: []string{"[10.0.0.2]:80", "[10.0.0.3]:80", "[10.0.0.4]:80"}}
+
+	// probes wait for a dial slot like any dial
+	assert.Equal(t, r.addrs, d.precheck(context.Background(), r).addrs)
+	assert.Equal(t, 1, peak)
+
+	// a caller giving up doesn't make slow addresses look unreachable
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r.addrs = append(r.addrs, "[10.0.0.1]:80")
+	assert.Equal(t, r.addrs, d.precheck(ctx, r).addrs)
+	close(slow)
+}
@@ -0,0 +1,258 @@
+package cdialer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConnectProxy dials targets through an HTTP CONNECT proxy. The proxy's own
+// addresses are resolved, cached and rotated by Dialer, so a broken proxy
+// instance is evicted like any other address, whether it refuses the
+// connection or fails the CONNECT.
+type ConnectProxy struct {
+	Dialer    *Dialer
+	ProxyAddr string
+	Header    http.Header
+}
+
+func (p *ConnectProxy) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but bounds both connecting to the proxy and the
+// CONNECT handshake by ctx.
+func (p *ConnectProxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errors.New(`dialer: can't CONNECT over "` + network + `"`)
+	}
+
+	ctx = p.Dialer.withHandshake(ctx, func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		return p.connect(ctx, conn, address)
+	})
+	return p.Dialer.DialContext(ctx, network, p.ProxyAddr)
+}
+
+// connect asks the proxy on conn to connect to address.
+func (p *ConnectProxy) connect(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	header := p.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: header,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(`dialer: proxy refused CONNECT to "` + address + `": ` + resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn hands out bytes the proxy sent right after its response
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SOCKS5Proxy dials targets through a SOCKS5 proxy, resolving and rotating
+// the proxy's own addresses with Dialer like ConnectProxy. Set as the D of
+// another Dialer, that one resolves, caches and rotates the targets' IPs
+// locally and the proxy only connects to them. With RemoteResolve it's
+// handed host names instead, for the proxy to resolve, and that Dialer
+// caches nothing. It then can't check the addresses either, so it refuses
+// to dial if it has any address filter set.
+type SOCKS5Proxy struct {
+	Dialer    *Dialer
+	ProxyAddr string
+
+	// Username and Password, if set, authenticate to the proxy.
+	Username string
+	Password string
+
+	RemoteResolve bool
+}
+
+func (p *SOCKS5Proxy) resolvesRemotely() bool { return p.RemoteResolve }
+
+func (p *SOCKS5Proxy) Dial(network, address string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but bounds both connecting to the proxy and the
+// SOCKS5 handshake by ctx.
+func (p *SOCKS5Proxy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errors.New(`dialer: can't SOCKS5 CONNECT over "` + network + `"`)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New(`dialer: invalid port in "` + address + `"`)
+	}
+
+	conn, err := p.Dialer.DialContext(ctx, network, p.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := p.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *SOCKS5Proxy) handshake(conn net.Conn, host string, port uint16) error {
+	method := byte(socksNoAuth)
+	if p.Username != "" || p.Password != "" {
+		method = socksUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return err
+	}
+	if b[0] != socksVersion || b[1] != method {
+		return errors.New("dialer: SOCKS5 proxy refused the authentication method")
+	}
+
+	if method == socksUserPass {
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("dialer: SOCKS5 username or password too long")
+		}
+		req := []byte{1, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("dialer: SOCKS5 proxy rejected the credentials")
+		}
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New(`dialer: host "` + host + `" too long for SOCKS5`)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [4]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion {
+		return errors.New("dialer: invalid SOCKS5 reply")
+	}
+	if resp[1] != 0 {
+		return errors.New(`dialer: SOCKS5 proxy refused CONNECT to "` + net.JoinHostPort(host, strconv.Itoa(int(port))) + `": ` + socksReply(resp[1]))
+	}
+
+	// skip the address the proxy bound
+	var n int
+	switch resp[3] {
+	case socksIPv4:
+		n = net.IPv4len
+	case socksIPv6:
+		n = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return errors.New("dialer: invalid SOCKS5 reply")
+	}
+	_, err := io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksUserPass = 2
+	socksConnect  = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+)
+
+var socksReplies = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socksReply(code byte) string {
+	if int(code) < len(socksReplies) {
+		return socksReplies[code]
+	}
+	return "unknown error " + strconv.Itoa(int(code))
+}
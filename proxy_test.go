@@ -0,0 +1,272 @@
+package cdialer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeConnectProxy(t *testing.T) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				targets <- req.Method + " " + req.Host
+				if req.Host == "forbidden.com:443" {
+					io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+			}()
+		}
+	}()
+	return l, targets
+}
+
+func TestConnectProxyFailover(t *testing.T) {
+	l, targets := fakeConnectProxy(t)
+	defer l.Close()
+
+	// an instance that's up but can't reach anything
+	bad, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer bad.Close()
+	go func() {
+		for {
+			conn, err := bad.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				}
+			}()
+		}
+	}()
+
+	used := map[string]int{}
+	p := &ConnectProxy{
+		ProxyAddr: "proxy.local:3128",
+		Dialer: &Dialer{
+			TTL: defaultTTL,
+			D: testDialer{d: func(network string, address string) (net.Conn, error) {
+				used[address]++
+				switch address {
+				case "[10.0.0.2]:3128":
+					return nil, errors.New("connection refused")
+				case "[10.0.0.3]:3128":
+					return net.Dial(network, bad.Addr().String())
+				}
+				return net.Dial(network, l.Addr().String())
+			}},
+			LookupIP: func(host string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}, nil
+			},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := p.Dial("tcp", "github.com:443")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "CONNECT github.com:443", <-targets)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		greeting, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(greeting))
+		conn.Close()
+	}
+	// the refusing and the failing proxy addresses are each tried once,
+	// within a dial that goes on to the next
+	assert.Equal(t, 1, used["[10.0.0.2]:3128"])
+	assert.Equal(t, 1, used["[10.0.0.3]:3128"])
+	assert.Equal(t, 3, used["[10.0.0.1]:3128"])
+	assert.Equal(t, entry(p.Dialer, "proxy.local:3128").addrs, []string{"[10.0.0.1]:3128"})
+}
+
+func TestConnectProxyRefused(t *testing.T) {
+	l, targets := fakeConnectProxy(t)
+	defer l.Close()
+
+	p := &ConnectProxy{
+		ProxyAddr: l.Addr().String(),
+		Dialer: &Dialer{
+			TTL: defaultTTL,
+			LookupIP: func(host string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP(host)}, nil
+			},
+		},
+	}
+
+	_, err := p.Dial("tcp", "forbidden.com:443")
+	assert.Error(t, err)
+	assert.Equal(t, "CONNECT forbidden.com:443", <-targets)
+
+	_, err = p.Dial("udp", "github.com:53")
+	assert.Error(t, err)
+}
+
+// fakeSOCKS5Proxy accepts CONNECTs, with the given credentials if any,
+// and reports their targets. It refuses those to port 25.
+func fakeSOCKS5Proxy(t *testing.T, user, pass string) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:2])
+				methods := buf[:buf[1]]
+				io.ReadFull(conn, methods)
+				if user != "" {
+					conn.Write([]byte{5, 2})
+					io.ReadFull(conn, buf[:2])
+					u := make([]byte, buf[1])
+					io.ReadFull(conn, u)
+					io.ReadFull(conn, buf[:1])
+					p := make([]byte, buf[0])
+					io.ReadFull(conn, p)
+					if string(u) != user || string(p) != pass {
+						conn.Write([]byte{1, 1})
+						return
+					}
+					conn.Write([]byte{1, 0})
+				} else {
+					conn.Write([]byte{5, 0})
+				}
+
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 4:
+					io.ReadFull(conn, buf[:16])
+					host = net.IP(buf[:16]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					name := make([]byte, buf[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				targets <- net.JoinHostPort(host, strconv.Itoa(port))
+				if port == 25 {
+					conn.Write([]byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x04, 0x38})
+				io.WriteString(conn, "hello")
+			}()
+		}
+	}()
+	return l, targets
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	l, targets := fakeSOCKS5Proxy(t, "", "")
+	defer l.Close()
+
+	lookups := 0
+	proxy := &SOCKS5Proxy{Dialer: &Dialer{}, ProxyAddr: l.Addr().String()}
+	d := &Dialer{
+		D:   proxy,
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil
+		},
+		Strategy: FirstHealthy{},
+	}
+
+	// resolved locally, so the proxy connects to the cached IPs
+	conn, err := d.Dial("tcp", "github.com:443")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "10.0.0.1:443", <-targets)
+		b := make([]byte, 5)
+		io.ReadFull(conn, b)
+		assert.Equal(t, "hello", string(b))
+		conn.Close()
+	}
+	assert.Equal(t, 1, lookups)
+
+	d.Evict("github.com:443")
+
+	// or left for the proxy to resolve
+	proxy.RemoteResolve = true
+	conn, err = d.Dial("tcp", "gitlab.com:443")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gitlab.com:443", <-targets)
+		conn.Close()
+	}
+	assert.Equal(t, 1, lookups)
+	assert.Empty(t, d.Snapshot())
+
+	_, err = d.Dial("tcp", "github.com:25")
+	assert.ErrorContains(t, err, "connection not allowed by ruleset")
+	<-targets
+
+	_, err = d.Dial("udp", "github.com:53")
+	assert.ErrorContains(t, err, "can't SOCKS5 CONNECT")
+
+	// the proxy's answers can't be filtered
+	d.BlockPrivateIPs = true
+	_, err = d.Dial("tcp", "gitlab.com:443")
+	assert.ErrorIs(t, err, errRemoteFiltered)
+	d.BlockPrivateIPs = false
+	d.ExcludeIPv6 = true
+	_, err = d.Dial("tcp", "gitlab.com:443")
+	assert.ErrorIs(t, err, errRemoteFiltered)
+}
+
+func TestSOCKS5ProxyAuth(t *testing.T) {
+	l, targets := fakeSOCKS5Proxy(t, "alice", "secret")
+	defer l.Close()
+
+	proxy := &SOCKS5Proxy{Dialer: &Dialer{}, ProxyAddr: l.Addr().String(), Username: "alice", Password: "secret"}
+	conn, err := proxy.Dial("tcp", "[2001:db8::1]:443")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[2001:db8::1]:443", <-targets)
+		conn.Close()
+	}
+
+	proxy.Password = "wrong"
+	_, err = proxy.Dial("tcp", "github.com:443")
+	assert.ErrorContains(t, err, "rejected the credentials")
+
+	proxy.Username, proxy.Password = "", ""
+	_, err = proxy.Dial("tcp", "github.com:443")
+	assert.ErrorContains(t, err, "refused the authentication method")
+}
@@ -0,0 +1,81 @@
+package cdialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader sends conn's PROXY protocol header, bounded by ctx.
+func (d *Dialer) writeProxyHeader(ctx context.Context, conn net.Conn) error {
+	src, dst := conn.LocalAddr(), conn.RemoteAddr()
+	if d.ProxyAddrs != nil {
+		src, dst = d.ProxyAddrs(ctx, conn)
+	}
+	header, err := proxyHeader(d.ProxyProtocol, src, dst)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// proxyHeader returns the PROXY protocol header of version for a
+// connection from src to dst. Unless both are TCP addresses, it doesn't
+// tell them.
+func proxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	s, _ := src.(*net.TCPAddr)
+	t, _ := dst.(*net.TCPAddr)
+	known := s != nil && t != nil && s.IP != nil && t.IP != nil
+	ipv4 := known && s.IP.To4() != nil && t.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto, sip, tip := "TCP4", s.IP.String(), t.IP.String()
+		if !ipv4 {
+			proto, sip, tip = "TCP6", ipv6String(s.IP), ipv6String(t.IP)
+		}
+		return []byte("PROXY " + proto + " " + sip + " " + tip + " " +
+			strconv.Itoa(s.Port) + " " + strconv.Itoa(t.Port) + "\r\n"), nil
+
+	case 2:
+		b := append([]byte(nil), proxyV2Signature...)
+		switch {
+		case !known:
+			return append(b, 0x20, 0, 0, 0), nil // LOCAL, unspecified
+		case ipv4:
+			b = append(b, 0x21, 0x11, 0, 12)
+			b = append(b, s.IP.To4()...)
+			b = append(b, t.IP.To4()...)
+		default:
+			b = append(b, 0x21, 0x21, 0, 36)
+			b = append(b, s.IP.To16()...)
+			b = append(b, t.IP.To16()...)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(s.Port))
+		return binary.BigEndian.AppendUint16(b, uint16(t.Port)), nil
+	}
+	return nil, errors.New("dialer: unknown PROXY protocol version " + strconv.Itoa(version))
+}
+
+// ipv6String formats ip as an IPv6 address, IPv4 ones in their IPv4-mapped
+// form, which a TCP6 line needs even when only one end is IPv6.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,88 @@
+package cdialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+
+	for _, tc := range []struct {
+		version  int
+		src, dst net.Addr
+		want     string
+	}{
+		{1, v4src, v4dst, "PROXY TCP4 192.0.2.1 10.0.0.1 56324 443\r\n"},
+		{1, v6src, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{1, v4src, v6dst, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+		{1, v6src, v4dst, "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 56324 443\r\n"},
+		{1, nil, v4dst, "PROXY UNKNOWN\r\n"},
+		{1, &net.UnixAddr{Name: "/tmp/sock"}, v4dst, "PROXY UNKNOWN\r\n"},
+		{2, v4src, v4dst, sig + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x01" + "\x0a\x00\x00\x01" + "\xdc\x04" + "\x01\xbb"},
+		{2, v6src, v6dst, sig + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xdc\x04" + "\x01\xbb"},
+		{2, nil, nil, sig + "\x20\x00\x00\x00"},
+	} {
+		header, err := proxyHeader(tc.version, tc.src, tc.dst)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, string(header))
+	}
+
+	_, err := proxyHeader(3, v4src, v4dst)
+	assert.ErrorContains(t, err, "unknown PROXY protocol version 3")
+}
+
+type clientAddrKey struct{}
+
+func TestDialProxyProtocol(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	d := withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return client, nil
+		}},
+		TTL:           defaultTTL,
+		ProxyProtocol: 1,
+		ProxyAddrs: func(ctx context.Context, conn net.Conn) (net.Addr, net.Addr) {
+			src, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+			return src, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now()},
+	})
+
+	got := make(chan string, 1)
+	go func() {
+		want := "PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\n"
+		b := make([]byte, len(want)+5)
+		io.ReadFull(server, b)
+		got <- string(b)
+	}()
+
+	ctx := context.WithValue(context.Background(), clientAddrKey{}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324})
+	conn, err := d.DialContext(ctx, "tcp", "github.com:80")
+	if assert.NoError(t, err) {
+		io.WriteString(conn, "hello")
+		assert.Equal(t, "PROXY TCP4 192.0.2.1 10.0.0.1 56324 80\r\nhello", <-got)
+	}
+
+	// a connection the header can't be written to isn't returned
+	server.Close()
+	d.ProxyProtocol = 2
+	_, err = d.Dial("tcp", "github.com:80")
+	assert.Error(t, err)
+}
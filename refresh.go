@@ -0,0 +1,158 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Warm resolves and caches hosts, given as "host:port" like to Dial, ahead
+// of the first dials. Hosts are resolved concurrently and those that fail
+// don't keep the rest from being cached. The failures are joined in the
+// returned error. Hosts not started yet when ctx is done fail with its
+// error.
+func (d *Dialer) Warm(ctx context.Context, hosts ...string) error {
+	errs := make([]error, len(hosts))
+
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		if err := ctx.Err(); err != nil {
+			errs[i] = fmt.Errorf("%s: %w", host, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+
+			_, addrs, err := d.getAddrs(ctx, host)
+			if err == nil && len(addrs) == 0 {
+				err = errors.New(`can't resolve host "` + host + `"`)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", host, &dialError{ErrResolutionFailed, err})
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// Refresh re-resolves host right away, regardless of its TTL or any
+// resolution throttling, and restarts its TTL and address rotation. Hosts
+// that aren't cached yet are added. On failure the cached entry is left
+// as it was.
+func (d *Dialer) Refresh(host string) error {
+	start := time.Now()
+	r, err := d.lookup(context.Background(), host)
+	ev := resolveEvent{host: host, addrs: len(r.addrs), took: time.Since(start), err: err, done: true}
+	if err != nil {
+		d.noteResolve(ev)
+		return &dialError{ErrResolutionFailed, err}
+	}
+	r = d.precheck(context.Background(), r)
+
+	s := d.addrs.shard(host)
+	s.mx.Lock()
+	if d.MinResolveInterval > 0 {
+		d.mx.Lock()
+		if d.lastResolve == nil {
+			d.lastResolve = map[string]resolveResult{}
+		}
+		d.lastResolve[host] = resolveResult{at: time.Now()}
+		d.mx.Unlock()
+	}
+	addrs, expires := d.storeAddrs(s, host, r), d.expiry(s, host)
+	e, _ := s.get(host)
+	atomic.StoreInt64(&e.idx, 0)
+	s.mx.Unlock()
+	d.share(host, r, expires)
+	d.noteResolve(ev)
+
+	d.noteHealth(host, len(addrs) > 0)
+	return nil
+}
+
+// Start launches a goroutine that keeps the cache warm by re-resolving
+// hosts shortly before their entries expire, so dials rarely have to wait
+// for a lookup. It does nothing if the refresh is already running. Call
+// Close to stop it.
+func (d *Dialer) Start() {
+	d.lifeMx.Lock()
+	defer d.lifeMx.Unlock()
+
+	if d.stop != nil {
+		return
+	}
+
+	interval := d.RefreshInterval
+	if interval <= 0 {
+		d.mx.RLock()
+		interval = d.TTL / 10
+		d.mx.RUnlock()
+	}
+	if interval <= 0 {
+		interval = defaultTTL / 10
+	}
+
+	d.stop = make(chan struct{})
+	d.stopped = make(chan struct{})
+	go d.refreshLoop(interval, d.stop, d.stopped)
+}
+
+// Close stops the background refresh and waits for it to exit. It's safe
+// to call more than once and without a prior Start.
+func (d *Dialer) Close() error {
+	d.lifeMx.Lock()
+	defer d.lifeMx.Unlock()
+
+	if d.stop == nil {
+		return nil
+	}
+	close(d.stop)
+	<-d.stopped
+	d.stop, d.stopped = nil, nil
+	return nil
+}
+
+func (d *Dialer) refreshLoop(interval time.Duration, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.refreshExpiring(interval)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// refreshExpiring re-resolves the entries that expire within the window,
+// skipping those a stale-while-revalidate refresh is already working on.
+func (d *Dialer) refreshExpiring(within time.Duration) {
+	now := time.Now()
+
+	expiring := map[string]*hostEntry{}
+	d.addrs.rlockAll()
+	d.addrs.each(func(key string, e *hostEntry) bool {
+		if e.resolved.Add(d.ttl(e)).Sub(now) <= within {
+			expiring[key] = e
+		}
+		return true
+	})
+	d.addrs.runlockAll()
+
+	for key, e := range expiring {
+		if atomic.CompareAndSwapInt32(&e.refreshing, 0, 1) {
+			d.refresh(key, e)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartRefreshesExpiringHosts(t *testing.T) {
+	var lookups int32
+	d := withEntries(&Dialer{
+		TTL:             time.Hour,
+		RefreshInterval: 10 * time.Millisecond,
+		LookupIP: func(host string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-time.Hour)},
+		"gitlab.com:80": {addrs: []string{"10.0.1.1:80"}, resolved: time.Now()},
+	})
+
+	d.Start()
+	d.Start()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&lookups) > 0
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, d.Close())
+	assert.NoError(t, d.Close())
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+	assert.Equal(t, []string{"[10.0.0.2]:80"}, entry(d, "github.com:80").addrs)
+	assert.Equal(t, []string{"10.0.1.1:80"}, entry(d, "gitlab.com:80").addrs)
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	d := &Dialer{}
+	assert.NoError(t, d.Close())
+	assert.NoError(t, d.Close())
+}
+
+func TestRefresh(t *testing.T) {
+	lookupErr := errors.New("no such host")
+	ips := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	d := withEntries(&Dialer{
+		TTL:                time.Hour,
+		MinResolveInterval: time.Hour,
+		LookupIP: func(host string) ([]net.IP, error) {
+			if ips == nil {
+				return nil, lookupErr
+			}
+			return ips, nil
+		},
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80"}, resolved: time.Now().Add(-time.Minute), idx: 7},
+	})
+
+	assert.NoError(t, d.Refresh("github.com:80"))
+	e := entry(d, "github.com:80")
+	assert.Equal(t, []string{"[10.0.0.2]:80", "[10.0.0.3]:80"}, e.addrs)
+	assert.Equal(t, int64(0), e.idx)
+	assert.WithinDuration(t, time.Now(), e.resolved, time.Second)
+
+	assert.NoError(t, d.Refresh("gitlab.com:80"))
+	assert.Equal(t, []string{"[10.0.0.2]:80", "[10.0.0.3]:80"}, entry(d, "gitlab.com:80").addrs)
+
+	ips = nil
+	err := d.Refresh("github.com:80")
+	assert.ErrorIs(t, err, lookupErr)
+	assert.Equal(t, []string{"[10.0.0.2]:80", "[10.0.0.3]:80"}, entry(d, "github.com:80").addrs)
+}
+
+func TestWarm(t *testing.T) {
+	var lookups int32
+	lookupErr := errors.New("no such host")
+	d := &Dialer{
+		TTL: time.Hour,
+		LookupIP: func(host string) ([]net.IP, error) {
+			atomic.AddInt32(&lookups, 1)
+			if host == "broken.com" {
+				return nil, lookupErr
+			}
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	err := d.Warm(context.Background(), "github.com:80", "broken.com:80", "gitlab.com:443")
+	assert.ErrorIs(t, err, lookupErr)
+	assert.ErrorIs(t, err, ErrResolutionFailed)
+	assert.ErrorContains(t, err, "broken.com:80")
+	assert.NotContains(t, err.Error(), "github.com")
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(d, "github.com:80").addrs)
+	assert.Equal(t, []string{"[10.0.0.1]:443"}, entry(d, "gitlab.com:443").addrs)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lookups))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = d.Warm(ctx, "bitbucket.org:80")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&lookups))
+	assert.NoError(t, d.Warm(context.Background()))
+}
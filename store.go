@@ -0,0 +1,175 @@
+package cdialer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Resolution is what a Cache keeps for a host: the addresses to dial and
+// when they expire.
+type Resolution struct {
+	Addrs   []string
+	Expires time.Time
+}
+
+// Cache is a resolution store that several Dialers can share, so that a
+// host resolved by one of them isn't resolved again by the others. Keys
+// are cache keys as in Snapshot. Implementations must be safe for
+// concurrent use.
+type Cache interface {
+	Get(key string) (Resolution, bool)
+	Set(key string, r Resolution)
+	Delete(key string)
+}
+
+// MemoryCache is an in-process Cache. The zero value is ready to use.
+type MemoryCache struct {
+	mx sync.RWMutex
+	m  map[string]Resolution
+}
+
+// Get returns the resolution stored under key, unless it expired.
+func (c *MemoryCache) Get(key string) (Resolution, bool) {
+	c.mx.RLock()
+	r, ok := c.m[key]
+	c.mx.RUnlock()
+	if !ok || !time.Now().Before(r.Expires) {
+		return Resolution{}, false
+	}
+	return r, true
+}
+
+func (c *MemoryCache) Set(key string, r Resolution) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.m == nil {
+		c.m = map[string]Resolution{}
+	}
+	c.m[key] = r
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.mx.Lock()
+	delete(c.m, key)
+	c.mx.Unlock()
+}
+
+// stored returns the unexpired resolution of key in the Store, if any,
+// through the Dialer's own address filters: whoever stored it may filter
+// differently. Resolutions the filters leave nothing of are ignored.
+func (d *Dialer) stored(key string) (lookupResult, bool) {
+	if d.Store == nil {
+		return lookupResult{}, false
+	}
+	res, ok := d.Store.Get(key)
+	ttl := time.Until(res.Expires)
+	if !ok || ttl <= 0 || len(res.Addrs) == 0 {
+		return lookupResult{}, false
+	}
+
+	wantIPv4, wantIPv6, address := splitCacheKey(key)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return lookupResult{}, false
+	}
+	ipAddrs := make([]net.IPAddr, 0, len(res.Addrs))
+	for _, addr := range res.Addrs {
+		if ip, ok := parseIPZone(addrIP(addr)); ok {
+			ipAddrs = append(ipAddrs, ip)
+		}
+	}
+	r, err := d.portAddrs(wantIPv4, wantIPv6, host, port, ipAddrs, ttl)
+	if err != nil || len(r.addrs) == 0 {
+		return lookupResult{}, false
+	}
+	return r, true
+}
+
+// share puts what a lookup of key found in the Store. SRV results aren't
+// shared since their priorities wouldn't survive.
+func (d *Dialer) share(key string, r lookupResult, expires time.Time) {
+	if d.Store == nil || r.prio != nil {
+		return
+	}
+	d.Store.Set(key, Resolution{Addrs: append([]string(nil), r.addrs...), Expires: expires})
+}
+
+// FileCache is a MemoryCache that can be saved to a file and loaded back,
+// so that short-lived processes don't resolve the same hosts on every run.
+type FileCache struct {
+	MemoryCache
+}
+
+// Load replaces the cache's contents with the unexpired resolutions saved
+// at path. A missing file isn't an error. A corrupt or truncated one
+// leaves the cache empty, as does any other error.
+func (c *FileCache) Load(path string) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.m = nil
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]Resolution
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	now := time.Now()
+	for key, r := range saved {
+		if !now.Before(r.Expires) || len(r.Addrs) == 0 {
+			delete(saved, key)
+		}
+	}
+	c.m = saved
+	return nil
+}
+
+// Save writes the unexpired resolutions to path. The file is replaced
+// atomically, so a crash midway leaves the previous one in place.
+func (c *FileCache) Save(path string) error {
+	now := time.Now()
+	c.mx.RLock()
+	saved := make(map[string]Resolution, len(c.m))
+	for key, r := range c.m {
+		if now.Before(r.Expires) {
+			saved[key] = r
+		}
+	}
+	b, err := json.Marshal(saved)
+	c.mx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	var c MemoryCache
+
+	_, ok := c.Get("github.com:80")
+	assert.False(t, ok)
+
+	r := Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(time.Minute)}
+	c.Set("github.com:80", r)
+	got, ok := c.Get("github.com:80")
+	assert.True(t, ok)
+	assert.Equal(t, r, got)
+
+	c.Set("gitlab.com:80", Resolution{Addrs: []string{"[10.0.1.1]:80"}, Expires: time.Now().Add(-time.Second)})
+	_, ok = c.Get("gitlab.com:80")
+	assert.False(t, ok)
+
+	c.Delete("github.com:80")
+	_, ok = c.Get("github.com:80")
+	assert.False(t, ok)
+}
+
+func TestSharedStore(t *testing.T) {
+	lookups := map[string]int{}
+	store := &MemoryCache{}
+	newDialer := func(name string) *Dialer {
+		return &Dialer{
+			D: testDialer{d: func(network string, address string) (net.Conn, error) {
+				return nil, nil
+			}},
+			TTL:   time.Minute,
+			Store: store,
+			LookupIP: func(host string) ([]net.IP, error) {
+				lookups[name]++
+				return []net.IP{net.ParseIP("10.0.0.1")}, nil
+			},
+		}
+	}
+	a, b := newDialer("a"), newDialer("b")
+
+	_, err := a.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	_, err = b.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1}, lookups)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(b, "github.com:80").addrs)
+
+	// the Store's expiry carries over
+	ttl := b.Snapshot()["github.com:80"].TTL
+	assert.True(t, ttl > 50*time.Second && ttl <= time.Minute)
+
+	// evictions stay with the Dialer, Evict reaches the Store
+	b.evictAddr("github.com:80", "[10.0.0.1]:80", nil)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, entry(a, "github.com:80").addrs)
+	_, ok := store.Get("github.com:80")
+	assert.True(t, ok)
+
+	assert.True(t, a.Evict("github.com:80"))
+	_, ok = store.Get("github.com:80")
+	assert.False(t, ok)
+	_, err = b.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, lookups)
+}
+
+func TestSharedStoreRetryCycle(t *testing.T) {
+	store := &MemoryCache{}
+	store.Set("github.com:80", Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(time.Minute)})
+
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address == "[10.0.0.1]:80" {
+				return nil, errors.New("connection refused")
+			}
+			return nil, nil
+		}},
+		TTL:        time.Minute,
+		Store:      store,
+		RetryCycle: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+
+	// the retry resolves instead of getting the dead address back
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[10.0.0.1]:80", "[10.0.0.2]:80"}, dialed)
+	r, _ := store.Get("github.com:80")
+	assert.Equal(t, []string{"[10.0.0.2]:80"}, r.Addrs)
+}
+
+func TestSharedStoreFilters(t *testing.T) {
+	store := &MemoryCache{}
+	store.Set("github.com:80", Resolution{
+		Addrs:   []string{"[127.0.0.1]:80", "[10.0.0.1]:80", "[2001:db8::1]:80"},
+		Expires: time.Now().Add(time.Minute),
+	})
+
+	lookups := 0
+	var dialed []string
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			return nil, nil
+		}},
+		TTL:             time.Minute,
+		Store:           store,
+		BlockPrivateIPs: true,
+		LookupIP: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+	}
+
+	// what the filters reject isn't dialed, whoever resolved it
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, lookups)
+	assert.Equal(t, []string{"[2001:db8::1]:80"}, entry(d, "github.com:80").addrs)
+
+	// and when nothing is left the Dialer looks the host up itself
+	store.Set("gitlab.com:80", Resolution{Addrs: []string{"[127.0.0.1]:80"}, Expires: time.Now().Add(time.Minute)})
+	_, err = d.Dial("tcp", "gitlab.com:80")
+	assert.ErrorIs(t, err, ErrAddrsBlocked)
+	assert.Equal(t, 1, lookups)
+	assert.Equal(t, []string{"[2001:db8::1]:80"}, dialed)
+}
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+
+	var c FileCache
+	assert.NoError(t, c.Load(path)) // nothing saved yet
+	c.Set("github.com:80", Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(time.Hour)})
+	c.Set("gitlab.com:80", Resolution{Addrs: []string{"[10.0.1.1]:80"}, Expires: time.Now().Add(-time.Second)})
+	assert.NoError(t, c.Save(path))
+
+	var loaded FileCache
+	assert.NoError(t, loaded.Load(path))
+	r, ok := loaded.Get("github.com:80")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"[10.0.0.1]:80"}, r.Addrs)
+	assert.Len(t, loaded.m, 1)
+
+	// entries expiring while saved are dropped on load
+	c.Set("github.com:80", Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(50 * time.Millisecond)})
+	assert.NoError(t, c.Save(path))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, loaded.Load(path))
+	assert.Empty(t, loaded.m)
+
+	// corrupt and truncated files start empty
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	for _, content := range [][]byte{[]byte("not json"), b[:len(b)/2]} {
+		loaded.Set("github.com:80", Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(time.Hour)})
+		assert.NoError(t, os.WriteFile(path, content, 0o600))
+		assert.Error(t, loaded.Load(path))
+		_, ok := loaded.Get("github.com:80")
+		assert.False(t, ok)
+	}
+
+	// a Dialer dials what a previous run saved without resolving
+	c.Set("github.com:80", Resolution{Addrs: []string{"[10.0.0.1]:80"}, Expires: time.Now().Add(time.Hour)})
+	assert.NoError(t, c.Save(path))
+	store := &FileCache{}
+	assert.NoError(t, store.Load(path))
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			return nil, nil
+		}},
+		TTL:   time.Hour,
+		Store: store,
+		LookupIP: func(host string) ([]net.IP, error) {
+			t.Fatal("resolved a host that was saved")
+			return nil, nil
+		},
+	}
+	_, addr, err := d.DialContextAddr(context.Background(), "tcp", "github.com:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "[10.0.0.1]:80", addr)
+}
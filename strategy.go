@@ -0,0 +1,78 @@
+package cdialer
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// SelectionStrategy picks the address to dial for host. addrs is the
+// non-empty, ordered list of addresses currently cached for it; Pick
+// returns an index into it.
+type SelectionStrategy interface {
+	Pick(host string, addrs []string) int
+}
+
+// RoundRobin rotates through each host's cached addresses independently,
+// like a Dialer with no Strategy does.
+type RoundRobin struct {
+	mx  sync.Mutex
+	idx map[string]int
+}
+
+func (s *RoundRobin) Pick(host string, addrs []string) int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.idx == nil {
+		s.idx = map[string]int{}
+	}
+	idx := s.idx[host] + 1
+	s.idx[host] = idx
+	return idx % len(addrs)
+}
+
+// Random picks one of the cached addresses uniformly at random.
+type Random struct{}
+
+func (Random) Pick(host string, addrs []string) int {
+	return rand.Intn(len(addrs))
+}
+
+// FirstHealthy always dials the first cached address. Since failing
+// addresses are evicted, it sticks to a primary and only moves on to the
+// next one once it fails.
+type FirstHealthy struct{}
+
+func (FirstHealthy) Pick(host string, addrs []string) int {
+	return 0
+}
+
+// Weighted picks addresses at random in proportion to their Weight.
+// Addresses weighing zero or less are skipped, unless all of them do, in
+// which case the pick is uniform.
+type Weighted struct {
+	Weight func(addr string) int
+}
+
+func (s Weighted) Pick(host string, addrs []string) int {
+	total := 0
+	for _, a := range addrs {
+		if w := s.Weight(a); w > 0 {
+			total += w
+		}
+	}
+	if total == 0 {
+		return rand.Intn(len(addrs))
+	}
+
+	pos := rand.Intn(total)
+	for i, a := range addrs {
+		if w := s.Weight(a); w > 0 {
+			pos -= w
+			if pos < 0 {
+				return i
+			}
+		}
+	}
+	return len(addrs) - 1
+}
@@ -0,0 +1,137 @@
+package cdialer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strategyDialer(s SelectionStrategy, used *[]string, fail map[string]bool) *Dialer {
+	return withEntries(&Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			*used = append(*used, address)
+			if fail[address] {
+				return nil, errors.New("Invalid address")
+			}
+			return nil, nil
+		}},
+		TTL:         defaultTTL,
+		Strategy:    s,
+		MaxAttempts: 1,
+	}, map[string]*hostEntry{
+		"github.com:80": {addrs: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, resolved: time.Now()},
+	})
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	var used []string
+	d := strategyDialer(&RoundRobin{}, &used, nil)
+
+	for i := 0; i < 6; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, []string{
+		"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80",
+		"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80",
+	}, used)
+}
+
+func TestRandomStrategy(t *testing.T) {
+	var used []string
+	d := strategyDialer(Random{}, &used, nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	for _, addr := range used {
+		counts[addr]++
+	}
+	assert.Len(t, counts, 3)
+	for _, n := range counts {
+		assert.InDelta(t, 1000, n, 200)
+	}
+}
+
+func TestFirstHealthyStrategy(t *testing.T) {
+	var used []string
+	d := strategyDialer(FirstHealthy{}, &used, map[string]bool{"10.0.0.1:80": true})
+
+	for i := 0; i < 4; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, []string{
+		"10.0.0.1:80", "10.0.0.2:80", "10.0.0.2:80", "10.0.0.2:80",
+	}, used)
+}
+
+type fixedStrategy int
+
+func (s fixedStrategy) Pick(host string, addrs []string) int {
+	return int(s)
+}
+
+func TestStrategyIndexOutOfRange(t *testing.T) {
+	var used []string
+	d := strategyDialer(fixedStrategy(7), &used, nil)
+
+	_, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.0.1:80"}, used)
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	weights := map[string]int{"10.0.0.1:80": 2, "10.0.0.2:80": 1, "10.0.0.3:80": 1}
+	var used []string
+	d := strategyDialer(Weighted{Weight: func(addr string) int { return weights[addr] }}, &used, nil)
+
+	const dials = 4000
+	for i := 0; i < dials; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	counts := map[string]int{}
+	for _, a := range used {
+		counts[a]++
+	}
+	assert.InDelta(t, dials/2, counts["10.0.0.1:80"], dials/20)
+	assert.InDelta(t, dials/4, counts["10.0.0.2:80"], dials/20)
+	assert.InDelta(t, dials/4, counts["10.0.0.3:80"], dials/20)
+
+	used = nil
+	weights = map[string]int{"10.0.0.3:80": 1}
+	for i := 0; i < 10; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, 10, len(used))
+	assert.NotContains(t, used, "10.0.0.1:80")
+	assert.NotContains(t, used, "10.0.0.2:80")
+
+	used = nil
+	weights = nil
+	for i := 0; i < 10; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Len(t, used, 10)
+}
+
+func TestAffinity(t *testing.T) {
+	var used []string
+	fail := map[string]bool{}
+	d := strategyDialer(nil, &used, fail)
+	d.Affinity = true
+
+	for i := 0; i < 3; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.2:80", "10.0.0.2:80"}, used)
+
+	used = nil
+	fail["10.0.0.2:80"] = true
+	for i := 0; i < 3; i++ {
+		d.Dial("tcp", "github.com:80")
+	}
+	assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.1:80", "10.0.0.1:80"}, used)
+}
@@ -0,0 +1,36 @@
+package cdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// DialTLSContext dials host like DialContext and does a TLS handshake over
+// the connection with TLSConfig, verifying the certificate against host's
+// name rather than the IP that was dialed, unless TLSConfig sets another
+// ServerName. It fits http.Transport's DialTLSContext.
+func (d *Dialer) DialTLSContext(ctx context.Context, network, host string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	config := d.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			config.ServerName = name
+		}
+	}
+
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
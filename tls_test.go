@@ -0,0 +1,71 @@
+package cdialer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTLSListener listens on 127.0.0.1 with httptest's certificate, valid
+// for that IP and example.com, and returns the config trusting it.
+func testTLSListener(t *testing.T) (net.Listener, *tls.Config) {
+	h := httptest.NewTLSServer(http.NotFoundHandler())
+	certs := h.TLS.Certificates
+	config := h.Client().Transport.(*http.Transport).TLSClientConfig
+	h.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, config
+}
+
+func TestDialTLSContext(t *testing.T) {
+	l, config := testTLSListener(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := &Dialer{
+		TTL: defaultTTL,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+		TLSConfig: &tls.Config{RootCAs: config.RootCAs},
+	}
+
+	conn, err := d.DialTLSContext(context.Background(), "tcp", "example.com:"+port)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", conn.(*tls.Conn).ConnectionState().ServerName)
+		conn.Close()
+	}
+	assert.Empty(t, d.TLSConfig.ServerName)
+
+	_, err = d.DialTLSContext(context.Background(), "tcp", "github.com:"+port)
+	var hostErr x509.HostnameError
+	assert.ErrorAs(t, err, &hostErr)
+
+	d.TLSConfig.ServerName = "example.com"
+	conn, err = d.DialTLSContext(context.Background(), "tcp", "github.com:"+port)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package cdialer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Tracer starts the spans of dials, lookups and connection attempts.
+// It's a subset of what tracing libraries offer, so that adapting one,
+// like an OpenTelemetry trace.Tracer, takes a few lines.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type spanKey struct{}
+
+// startSpan starts a span named name if there's a Tracer, or else returns
+// ctx and a nil Span.
+func (d *Dialer) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if d.Tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := d.Tracer.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFrom returns the innermost span the Dialer started for ctx.
+func spanFrom(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// endSpan ends span, recording *errp if it's set. It's meant to be
+// deferred, and then also records a panic, which it carries on.
+func endSpan(span Span, errp *error) {
+	if r := recover(); r != nil {
+		span.RecordError(fmt.Errorf("panic: %v", r))
+		span.End()
+		panic(r)
+	}
+	if *errp != nil {
+		span.RecordError(*errp)
+	}
+	span.End()
+}
+
+// setAttribute sets key on the span the Dialer started for ctx, if any.
+func (d *Dialer) setAttribute(ctx context.Context, key string, value interface{}) {
+	if d.Tracer == nil {
+		return
+	}
+	if span := spanFrom(ctx); span != nil {
+		span.SetAttribute(key, value)
+	}
+}
+
+type attemptCountKey struct{}
+
+// withAttemptCount returns ctx counting the connection attempts made for
+// it in n.
+func withAttemptCount(ctx context.Context, n *int32) context.Context {
+	return context.WithValue(ctx, attemptCountKey{}, n)
+}
+
+// countAttempt counts an attempt made for ctx, if it's counting them.
+func countAttempt(ctx context.Context) {
+	if n, ok := ctx.Value(attemptCountKey{}).(*int32); ok {
+		atomic.AddInt32(n, 1)
+	}
+}
@@ -0,0 +1,138 @@
+package cdialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+}
+
+// SetAttribute and RecordError drop what comes after End, as tracers do.
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	if !s.ended {
+		s.attrs[key] = value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	if !s.ended {
+		s.errs = append(s.errs, err)
+	}
+}
+
+func (s *testSpan) End() { s.ended = true }
+
+type testTracer struct {
+	mx    sync.Mutex
+	spans []*testSpan
+}
+
+type testParentKey struct{}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testParentKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	t.mx.Lock()
+	t.spans = append(t.spans, span)
+	t.mx.Unlock()
+	return context.WithValue(ctx, testParentKey{}, span), span
+}
+
+func TestTracer(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	tracer := &testTracer{}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			if address == "[10.0.0.1]:80" {
+				return nil, errors.New("connection refused")
+			}
+			return client, nil
+		}},
+		TTL:      defaultTTL,
+		Strategy: FirstHealthy{},
+		Tracer:   tracer,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, nil
+		},
+	}
+
+	conn, err := d.Dial("tcp", "github.com:80")
+	assert.Nil(t, err)
+	assert.Equal(t, client, conn)
+
+	if assert.Len(t, tracer.spans, 4) {
+		dial, resolve, first, second := tracer.spans[0], tracer.spans[1], tracer.spans[2], tracer.spans[3]
+		assert.Equal(t, "cdialer.Dial", dial.name)
+		assert.Equal(t, map[string]interface{}{
+			"cdialer.host":      "github.com:80",
+			"cdialer.cache_hit": false,
+			"cdialer.addr":      "[10.0.0.2]:80",
+			"cdialer.attempts":  2,
+		}, dial.attrs)
+		assert.Empty(t, dial.errs)
+
+		assert.Equal(t, "cdialer.resolve", resolve.name)
+		assert.Equal(t, dial, resolve.parent)
+		assert.Equal(t, 2, resolve.attrs["cdialer.addrs"])
+
+		assert.Equal(t, "cdialer.connect", first.name)
+		assert.Equal(t, dial, first.parent)
+		assert.Equal(t, "[10.0.0.1]:80", first.attrs["cdialer.addr"])
+		assert.Len(t, first.errs, 1)
+		assert.Equal(t, "[10.0.0.2]:80", second.attrs["cdialer.addr"])
+		assert.Empty(t, second.errs)
+
+		for _, s := range tracer.spans {
+			assert.True(t, s.ended, s.name)
+		}
+	}
+
+	tracer.spans = nil
+	d.LookupIP = func(host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	}
+	_, err = d.Dial("tcp", "gitlab.com:80")
+	assert.NotNil(t, err)
+	if assert.Len(t, tracer.spans, 2) {
+		for _, s := range tracer.spans {
+			assert.Len(t, s.errs, 1, s.name)
+			assert.True(t, s.ended, s.name)
+		}
+	}
+}
+
+func TestTracerEndsSpansOnPanic(t *testing.T) {
+	tracer := &testTracer{}
+	d := &Dialer{
+		D: testDialer{d: func(network string, address string) (net.Conn, error) {
+			panic("boom")
+		}},
+		TTL:    defaultTTL,
+		Tracer: tracer,
+		LookupIP: func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		},
+	}
+
+	assert.Panics(t, func() { d.Dial("tcp", "github.com:80") })
+	if assert.Len(t, tracer.spans, 3) {
+		for _, s := range tracer.spans {
+			assert.True(t, s.ended, s.name)
+		}
+		assert.Len(t, tracer.spans[0].errs, 1)
+		assert.Len(t, tracer.spans[2].errs, 1)
+	}
+}